@@ -0,0 +1,36 @@
+package main
+
+// zx3info and zx3extract each have a wildMatch83 for their -match flags. This file is
+// part of both tools' tests, so the two are held to the same cases:
+//
+//	go test zx3info.go zx3info_test.go wildmatch83_test.go
+//	go test zx3extract.go zx3extract_test.go wildmatch83_test.go
+
+import "testing"
+
+func TestWildMatch83(t *testing.T) {
+	tests := []struct {
+		pattern, name, ext string
+		want               bool
+	}{
+		{"*.BAS", "LOADER", "BAS", true},
+		{"*.bas", "loader", "bas", true},
+		{"*.BAS", "LOADER", "BIN", false},
+		{"*.*", "README", "", true},
+		{"*", "README", "", true},
+		{"*", "GAME", "BIN", false}, // no dot: files without an extension only
+		{"GAME?.*", "GAME1", "BIN", true},
+		{"GAME?.*", "GAME", "BIN", true}, // '?' also takes the padding
+		{"GAME?.*", "GAME12", "BIN", false},
+		{"?????????.BIN", "GAME", "BIN", false}, // longer than the name field
+		{"DISK", "DISK", "", true},
+		{"DISK.", "DISK", "", true},
+		{"DISK", "DISKS", "", false},
+		{"A*B.C", "AXYZ", "C", true}, // '*' ends the field, as in CCP
+	}
+	for _, tt := range tests {
+		if got := wildMatch83(tt.pattern, tt.name, tt.ext); got != tt.want {
+			t.Errorf("wildMatch83(%q, %q, %q) = %v, want %v", tt.pattern, tt.name, tt.ext, got, tt.want)
+		}
+	}
+}
@@ -11,11 +11,18 @@ package main
 // Result: BASIC should fetch the correct first block for headed files.
 //
 // Geometry: SS, 40 tracks, 9x512, track size 0x1300; 1 reserved track; 2KB directory (4x512).
+// Other layouts are described by a Geometry; see KnownGeometries.
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/fs"
 	"os"
@@ -23,22 +30,147 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-const (
-	Tracks       = 40
-	Sides        = 1
-	SectorsPerTr = 9
-	SectorSize   = 512
-	TrackSize    = 0x1300 // 256 + 9*512
-
-	BlockSizeBytes = 1024
-	BlockSectors   = BlockSizeBytes / SectorSize // 2
-	DirBlocks      = 2                           // 2KB directory = 2 x 1KB blocks
+// SectorSize is the sector size of every geometry the writer handles; Disk stores
+// sectors as fixed arrays of it.
+const SectorSize = 512
+
+// Geometry describes a disk layout: the physical format and the CP/M parameters
+// that the +3 spec at T0,S1 records.
+type Geometry struct {
+	Name            string // -format name
+	Tracks, Sides   int    // cylinders and sides
+	SectorsPerTrack int
+	SectorSize      int
+	ReservedTracks  int // system tracks before the data area
+	BlockSize       int // allocation block size in bytes
+	DirBlocks       int // blocks reserved for the directory at the start of the data area
+	// Spec bytes 0 and 1: disk type, and sidedness (bits 0-1: 0 single, 1 alternate,
+	// 2 successive; bit 7 set for a double-track drive).
+	Type, Sidedness byte
+}
+
+var (
+	// Plus3Geometry is the standard +3/PCW CF2 single-sided 180K format.
+	Plus3Geometry = Geometry{Name: "180k", Tracks: 40, Sides: 1, SectorsPerTrack: 9, SectorSize: 512,
+		ReservedTracks: 1, BlockSize: 1024, DirBlocks: 2, Type: 0, Sidedness: 0x00}
+	// PCW720Geometry is the PCW CF2DD double-sided, double-track 720K format.
+	PCW720Geometry = Geometry{Name: "720k", Tracks: 80, Sides: 2, SectorsPerTrack: 9, SectorSize: 512,
+		ReservedTracks: 1, BlockSize: 2048, DirBlocks: 4, Type: 3, Sidedness: 0x81}
+
+	// KnownGeometries lists the formats the writer can produce.
+	KnownGeometries = []Geometry{Plus3Geometry, PCW720Geometry}
 )
 
+// geometryByName looks a geometry up by its -format name.
+func geometryByName(name string) (Geometry, bool) {
+	for _, g := range KnownGeometries {
+		if strings.EqualFold(g.Name, name) {
+			return g, true
+		}
+	}
+	return Geometry{}, false
+}
+
+// BlockSectors is the number of sectors per allocation block.
+func (g Geometry) BlockSectors() int { return g.BlockSize / g.SectorSize }
+
+// TrackSize is the EDSK size of one track: the Track-Info block plus its sectors.
+func (g Geometry) TrackSize() int { return 256 + g.SectorsPerTrack*g.SectorSize }
+
+// DataBlocks is the number of allocation blocks in the data area, directory included.
+func (g Geometry) DataBlocks() int {
+	return (g.Tracks*g.Sides - g.ReservedTracks) * g.SectorsPerTrack * g.SectorSize / g.BlockSize
+}
+
+// wideBlocks reports whether directory entries list 16-bit block numbers: CP/M packs
+// eight little-endian words instead of sixteen bytes once a disk has over 256 blocks.
+func (g Geometry) wideBlocks() bool { return g.DataBlocks() > 256 }
+
+// entryBlocks is the number of block numbers one directory entry holds.
+func (g Geometry) entryBlocks() int {
+	if g.wideBlocks() {
+		return 8
+	}
+	return 16
+}
+
+// blocksOf returns the block numbers listed in e, zeros included.
+func (g Geometry) blocksOf(e DirEntry) []int {
+	out := make([]int, g.entryBlocks())
+	for i := range out {
+		if g.wideBlocks() {
+			out[i] = int(binary.LittleEndian.Uint16(e[16+2*i:]))
+		} else {
+			out[i] = int(e[16+i])
+		}
+	}
+	return out
+}
+
+// extentMask is CP/M's EXM: one directory entry's block numbers span EXM+1 logical
+// 16KB extents, so with 2KB blocks an entry's RC counts records past a full first 16KB.
+func (g Geometry) extentMask() byte {
+	return byte(g.BlockSize*g.entryBlocks()/16384 - 1)
+}
+
+// DirEntries is the number of 32-byte directory entries.
+func (g Geometry) DirEntries() int { return g.DirSize() / 32 }
+
+// DirSize is the size in bytes of the directory area. The reader, writer and
+// free-space accounting all size the directory from it.
+func (g Geometry) DirSize() int { return g.DirBlocks * g.BlockSize }
+
+// Capacity is the number of bytes available to files.
+func (g Geometry) Capacity() int { return g.DataBlocks()*g.BlockSize - g.DirSize() }
+
+// Spec encodes the 16-byte +3/PCW disk specification stored at T0,S1.
+func (g Geometry) Spec() []byte {
+	shift := func(n int) byte {
+		var s byte
+		for ; 128<<s < n; s++ {
+		}
+		return s
+	}
+	return []byte{g.Type, g.Sidedness, byte(g.Tracks), byte(g.SectorsPerTrack), shift(g.SectorSize), byte(g.ReservedTracks),
+		shift(g.BlockSize), byte(g.DirBlocks), 0x2A, 0x52, 0, 0, 0, 0, 0, 0} // gaps: R/W 0x2A, format 0x52
+}
+
+// locate maps sector n of the data area (0-based) to its cylinder, side and sector ID.
+// Logical tracks include the reserved tracks; on alternate-sided disks they run
+// cyl0/side0, cyl0/side1, ...; on successive-sided ones up side 0 and then up side 1.
+func (g Geometry) locate(n int) CHS {
+	lt := g.ReservedTracks + n/g.SectorsPerTrack
+	c := CHS{Sect: byte(n%g.SectorsPerTrack + 1)}
+	switch {
+	case g.Sides == 1:
+		c.Track = byte(lt)
+	case g.Sidedness&3 == 2:
+		c.Track, c.Side = byte(lt%g.Tracks), byte(lt/g.Tracks)
+	default:
+		c.Track, c.Side = byte(lt/2), byte(lt%2)
+	}
+	return c
+}
+
 type CHS struct{ Track, Side, Sect byte }
-type Disk struct{ Sectors [][][SectorSize]byte }
+type Disk struct {
+	// Sectors is indexed by track (cylinder*Sides + side), then by sector ID-1.
+	Sectors [][][SectorSize]byte
+	// Geometry is the layout the sectors follow.
+	Geometry Geometry
+	// Track-Info data rate (0x12) and recording mode (0x13) written for every track.
+	DataRate, RecMode byte
+	// Compat supplies the creator string and Track-Info gap/filler bytes.
+	Compat CompatProfile
+	// Source holds the tracks of a loaded image as they were stored. When set, saving
+	// writes them back with their own sector IDs, sizes, status flags and gaps, only
+	// the contents of the sectors in Sectors being updated.
+	Source []TrackLayout
+}
 type DirEntry [32]byte
 
 type FileItem struct {
@@ -46,6 +178,41 @@ type FileItem struct {
 	Path   string
 	Size   int64
 	Data   []byte
+	User   byte          // CP/M user number (0..15)
+	Attr   byte          // attrReadOnly | attrSystem | attrArchive
+	Raw    bool          // Data is stored verbatim (it already carries any +3DOS header)
+	Plus3  *headerParams // header values from a -meta sidecar, used instead of chooseHeader
+	Fixed  bool          // Name83 comes from a rename map and is used exactly as given
+	Blocks []int         // source allocation blocks in file order (items read from a disk)
+	Stamps *[8]byte      // CP/M 3 create and update stamps read from a disk; used instead of Builder.Stamp
+	// Sidecars are the zx3extract files found beside Path: the -meta JSON applied to
+	// the item and any header copies (.hdr, .p3h) left out of the build.
+	Sidecars []string
+}
+
+// CP/M file attributes, stored in the high bits of the three extension bytes.
+const (
+	attrReadOnly = 1 << iota // t1'
+	attrSystem               // t2'
+	attrArchive              // t3'
+)
+
+// name83 returns the 11-byte NAME+EXT field with attribute bits stripped.
+func (e DirEntry) name83() string {
+	var nm [11]byte
+	for i := range nm {
+		nm[i] = e[1+i] & 0x7F
+	}
+	return string(nm[:])
+}
+
+func (e DirEntry) attr() byte {
+	return e[9]>>7 | (e[10]>>7)<<1 | (e[11]>>7)<<2
+}
+
+// extent returns the logical extent number (EX low 5 bits, S2 extent module).
+func (e DirEntry) extent() int {
+	return int(e[14]&0x3F)<<5 | int(e[12]&0x1F)
 }
 
 // ----- 8.3 helpers -----
@@ -80,6 +247,77 @@ func to83(base string) string {
 	return fmt.Sprintf("%-8s%-3s", fn, ext)
 }
 
+// CP/M 2.2 logical and physical device names; a file named like one of these
+// is legal on disk but confusing to CP/M tools that accept DEV: syntax.
+var cpmDevices = map[string]bool{
+	"CON": true, "AUX": true, "LST": true, "PRN": true, "PUN": true, "RDR": true, "NUL": true,
+	"TTY": true, "CRT": true, "LPT": true, "PTR": true, "PTP": true, "BAT": true,
+	"UC1": true, "UL1": true, "UR1": true, "UR2": true, "UP1": true, "UP2": true,
+}
+
+// droppedChars counts how many characters of a source file name did not survive
+// into its 8.3 form (the dot separating name and extension is not counted).
+func droppedChars(src, name83 string) int {
+	n := utf8.RuneCountInString(src)
+	if strings.Contains(src, ".") {
+		n--
+	}
+	kept := len(strings.TrimRight(name83[:8], " ")) + len(strings.TrimRight(name83[8:], " "))
+	if d := n - kept; d > 0 {
+		return d
+	}
+	return 0
+}
+
+// checkNames reports 8.3 names that lost more than maxDropped characters of their
+// source name, that collide with a CP/M device name, or that ended up without an
+// extension although the source had one.
+func checkNames(items []FileItem, maxDropped int) []string {
+	var out []string
+	for _, it := range items {
+		if it.Fixed {
+			continue
+		}
+		src := filepath.Base(it.Path)
+		if parseAtSuffix(src) != 0 { // "@addr" load-address suffix is intentional
+			src = src[:strings.LastIndex(src, "@")] + filepath.Ext(src)
+		}
+		base := strings.TrimRight(it.Name83[:8], " ")
+		ext := strings.TrimRight(it.Name83[8:], " ")
+		shown := base + "." + ext
+		if d := droppedChars(src, it.Name83); d > maxDropped {
+			out = append(out, fmt.Sprintf("%s -> %s: %d characters dropped", src, shown, d))
+		}
+		if cpmDevices[base] {
+			out = append(out, fmt.Sprintf("%s -> %s: name is a CP/M device name", src, shown))
+		}
+		if ext == "" && filepath.Ext(src) != "" {
+			out = append(out, fmt.Sprintf("%s -> %s: extension lost", src, shown))
+		}
+	}
+	return out
+}
+
+// strictNames reports every item whose 8.3 name is not simply its source file
+// name uppercased: truncated, filtered, de-duplicated or renamed in any other way.
+func strictNames(items []FileItem) []string {
+	var out []string
+	for _, it := range items {
+		if it.Fixed {
+			continue
+		}
+		src := filepath.Base(it.Path)
+		shown := strings.TrimRight(it.Name83[:8], " ")
+		if ext := strings.TrimRight(it.Name83[8:], " "); ext != "" {
+			shown += "." + ext
+		}
+		if strings.ToUpper(src) != shown {
+			out = append(out, fmt.Sprintf("%s -> %s", src, shown))
+		}
+	}
+	return out
+}
+
 // ----- +3DOS header -----
 func le32(x int) [4]byte { return [4]byte{byte(x), byte(x >> 8), byte(x >> 16), byte(x >> 24)} }
 func le16(x int) [2]byte { return [2]byte{byte(x), byte(x >> 8)} }
@@ -99,12 +337,96 @@ func plus3Header(body []byte, typ byte, p1, p2 int) []byte {
 	h[16], h[17] = bl[0], bl[1]
 	h[18], h[19] = p1le[0], p1le[1]
 	h[20], h[21] = p2le[0], p2le[1]
+	h[127] = plus3Checksum(h)
+	return h
+}
+
+// plus3Checksum is the +3DOS header checksum: sum of bytes 0..126 modulo 256.
+func plus3Checksum(h []byte) byte {
 	sum := 0
 	for i := 0; i < 127; i++ {
 		sum = (sum + int(h[i])) & 0xFF
 	}
-	h[127] = byte(sum)
-	return h
+	return byte(sum)
+}
+
+func isPlus3Header(h []byte) bool {
+	return len(h) >= 128 && bytes.Equal(h[0:8], []byte("PLUS3DOS")) && h[8] == 0x1A
+}
+
+// entryName formats the 8.3 name stored in a raw directory entry as NAME.EXT.
+func entryName(e []byte) string {
+	var nm [11]byte
+	for i := range nm {
+		nm[i] = e[1+i] & 0x7F
+	}
+	base := strings.TrimRight(string(nm[:8]), " ")
+	ext := strings.TrimRight(string(nm[8:]), " ")
+	return base + "." + ext
+}
+
+// looksPlus3Spec reports whether b holds a plausible +3/PCW disk specification: a known
+// disk type and sidedness, and sizes the +3DOS and PCW formats can use.
+func looksPlus3Spec(b []byte) bool {
+	return len(b) >= 16 && (b[0] == 0 || b[0] == 3) && b[1]&0x7C == 0 && b[1]&3 != 3 &&
+		b[2] >= 40 && b[3] >= 8 && b[4] == 2 && b[6] >= 3 && b[6] <= 7 && b[7] >= 1
+}
+
+// repairSpec returns an edit that writes the spec for the disk's geometry into T0,S1.
+// A spec that already looks valid is only replaced when force is set.
+func repairSpec(force bool) func(*Disk) ([]string, error) {
+	return func(d *Disk) ([]string, error) {
+		sec := d.sector(CHS{Track: 0, Side: 0, Sect: 1})
+		g := d.Geometry
+		if k, ok := geometryByName(g.Name); ok {
+			g = k // the standard spec, not one loadDisk took from the disk
+		}
+		old, want := append([]byte(nil), sec[:16]...), g.Spec()
+		if bytes.Equal(old, want) {
+			return nil, nil
+		}
+		if looksPlus3Spec(old) && !force {
+			return nil, fmt.Errorf("T0,S1 already holds a plausible spec (% X); use -force to replace it with the %s spec", old, d.Geometry.Name)
+		}
+		copy(sec[:16], want)
+		return []string{fmt.Sprintf("T0,S1 spec % X -> % X (%s)", old, want, d.Geometry.Name)}, nil
+	}
+}
+
+// fixChecksums recomputes the +3DOS header checksum of every file on the disk
+// whose first block starts with a PLUS3DOS header, writing corrected headers back.
+// It returns a description of each file that was fixed.
+func fixChecksums(d *Disk) ([]string, error) {
+	dir := d.readDir()
+	var fixed []string
+	for i := 0; i+32 <= len(dir); i += 32 {
+		e := dir[i : i+32]
+		// only the first extent (EX=0, S2=0) of a live, non-empty file carries the header
+		var de DirEntry
+		copy(de[:], e)
+		block := d.Geometry.blocksOf(de)[0]
+		if e[0] == 0xE5 || de.extent() != 0 || e[15] == 0 || block == 0 {
+			continue
+		}
+		b, err := d.readBlock(block)
+		if err != nil {
+			return fixed, fmt.Errorf("%s: %w", entryName(e), err)
+		}
+		if !isPlus3Header(b) {
+			continue
+		}
+		sum := plus3Checksum(b)
+		if sum == b[127] {
+			continue
+		}
+		old := b[127]
+		b[127] = sum
+		if err := d.writeBlock(block, b); err != nil {
+			return fixed, fmt.Errorf("%s: %w", entryName(e), err)
+		}
+		fixed = append(fixed, fmt.Sprintf("%s (checksum 0x%02X -> 0x%02X)", entryName(e), old, sum))
+	}
+	return fixed, nil
 }
 
 func parseAtSuffix(base string) int {
@@ -141,45 +463,177 @@ func chooseHeader(path string) (typ byte, p1, p2 int) {
 }
 
 // ----- EDSK writer -----
+// Track-Info data rate (0x12) and recording mode (0x13) values.
+const (
+	rateUnknown = 0
+	rateDD      = 1 // single/double density, 250/300 kbps
+	rateHD      = 2 // high density, 500 kbps
+	rateED      = 3 // extended density, 1 Mbps
+
+	modeUnknown = 0
+	modeFM      = 1
+	modeMFM     = 2
+)
+
+func parseDataRate(s string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "unknown":
+		return rateUnknown, nil
+	case "sd", "dd", "250":
+		return rateDD, nil
+	case "hd", "500":
+		return rateHD, nil
+	case "ed", "1000":
+		return rateED, nil
+	}
+	return 0, fmt.Errorf("unknown data rate %q (want sd|dd|hd|ed|unknown)", s)
+}
+
+func parseRecMode(s string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "unknown":
+		return modeUnknown, nil
+	case "fm":
+		return modeFM, nil
+	case "mfm":
+		return modeMFM, nil
+	}
+	return 0, fmt.Errorf("unknown recording mode %q (want fm|mfm|unknown)", s)
+}
+
+// CompatProfile is the set of cosmetic EDSK fields some emulators are picky about:
+// the Disk-Info creator string and the GAP#3 length and filler byte of each Track-Info.
+type CompatProfile struct {
+	Creator      string // at most 14 bytes
+	Gap3, Filler byte
+}
+
+// compatProfiles are the -compat choices; "zx3dsk" is what the writer has always produced.
+var compatProfiles = map[string]CompatProfile{
+	"zx3dsk":        {Creator: "zx3dsk+3 fix2", Gap3: 0x52, Filler: 0xE5},
+	"spectaculator": {Creator: "Spectaculator", Gap3: 0x2A, Filler: 0xE5},
+	"specide":       {Creator: "SPECIDE", Gap3: 0x4E, Filler: 0x00},
+	"cpcdiskxp":     {Creator: "CPCDiskXP v2.5", Gap3: 0x4E, Filler: 0xE5},
+}
+
+// TrackLayout is one track exactly as an EDSK image stores it: the Track-Info fields
+// and every sector's ID, status flags and stored bytes. Sectors may differ in size, and
+// a sector's Data may be longer than its N declares (several copies of a weak sector) or
+// shorter. A track without sectors is written as unformatted.
+type TrackLayout struct {
+	Cyl, Head         byte
+	DataRate, RecMode byte
+	N, Gap3, Filler   byte // Track-Info sector size code, GAP#3 length and filler byte
+	Sectors           []SectorLayout
+}
+
+// SectorLayout is one Track-Info sector list entry and the data stored for it.
+type SectorLayout struct {
+	C, H, R, N, ST1, ST2 byte
+	Data                 []byte
+}
+
+// trackLayouts describes the disk's tracks: those of Source with their sector contents
+// brought up to date, or for a new disk uniform tracks of sectors 1..N of 512 bytes.
+func (disk *Disk) trackLayouts() []TrackLayout {
+	if disk.Source != nil {
+		out := make([]TrackLayout, len(disk.Source))
+		bases := sectorBases(disk.Source)
+		for tr, t := range disk.Source {
+			t.Sectors = append([]SectorLayout(nil), t.Sectors...)
+			for i, sec := range t.Sectors {
+				if s := int(sec.R) - bases[tr]; s >= 0 && s < len(disk.Sectors[tr]) && len(sec.Data) == SectorSize {
+					t.Sectors[i].Data = disk.Sectors[tr][s][:]
+				}
+			}
+			out[tr] = t
+		}
+		return out
+	}
+	sides := disk.Geometry.Sides
+	out := make([]TrackLayout, len(disk.Sectors))
+	for tr := range disk.Sectors {
+		cyl, head := byte(tr/sides), byte(tr%sides)
+		t := TrackLayout{Cyl: cyl, Head: head, DataRate: disk.DataRate, RecMode: disk.RecMode,
+			N: 0x02, Gap3: disk.Compat.Gap3, Filler: disk.Compat.Filler} // N=2 -> 512
+		for s := range disk.Sectors[tr] {
+			t.Sectors = append(t.Sectors, SectorLayout{C: cyl, H: head, R: byte(s + 1), N: 0x02, Data: disk.Sectors[tr][s][:]})
+		}
+		out[tr] = t
+	}
+	return out
+}
+
 func writeEDSK(w io.Writer, disk *Disk) error {
+	return writeTracks(w, disk.Compat.Creator, disk.Geometry.Sides, disk.trackLayouts())
+}
+
+// writeTracks writes an extended DSK image holding tracks (cylinder*sides + side) as
+// described, each sized in the Disk-Info table to fit its own sectors.
+func writeTracks(w io.Writer, creator string, sides int, tracks []TrackLayout) error {
+	if sides < 1 || len(tracks)%sides != 0 || 0x34+len(tracks) > 256 {
+		return fmt.Errorf("%d track(s) on %d side(s) do not fit an EDSK Disk-Info block", len(tracks), sides)
+	}
 	hdr := make([]byte, 256)
 	copy(hdr[0x00:], []byte("EXTENDED CPC DSK File\r\nDisk-Info\r\n"))
-	copy(hdr[0x22:], []byte("zx3dsk+3 fix2"))
-	hdr[0x30] = byte(Tracks)
-	hdr[0x31] = byte(Sides)
-	for i := 0; i < Tracks*Sides && 0x34+i < 256; i++ {
-		hdr[0x34+i] = byte(TrackSize / 256)
+	copy(hdr[0x22:0x30], []byte(creator))
+	hdr[0x30] = byte(len(tracks) / sides)
+	hdr[0x31] = byte(sides)
+	for i, t := range tracks {
+		if len(t.Sectors) == 0 {
+			continue // unformatted: size 0, no Track-Info
+		}
+		if 0x18+len(t.Sectors)*8 > 256 {
+			return fmt.Errorf("track %d: %d sectors do not fit a Track-Info block", i, len(t.Sectors))
+		}
+		size := 256
+		for _, sec := range t.Sectors {
+			if len(sec.Data) > 0xFFFF {
+				return fmt.Errorf("track %d R%d: %d bytes is too long for a sector", i, sec.R, len(sec.Data))
+			}
+			size += len(sec.Data)
+		}
+		if size = (size + 255) / 256; size > 0xFF {
+			return fmt.Errorf("track %d: %d bytes is too long for the track size table", i, size*256)
+		}
+		hdr[0x34+i] = byte(size)
 	}
 	if _, err := w.Write(hdr); err != nil {
 		return err
 	}
 
-	for tr := 0; tr < Tracks; tr++ {
+	for i, t := range tracks {
+		if len(t.Sectors) == 0 {
+			continue
+		}
 		th := make([]byte, 256)
 		copy(th[0x00:], []byte("Track-Info\r\n"))
-		th[0x10] = byte(tr) // C
-		th[0x11] = 0x00     // H
-		th[0x14] = 0x02     // N=2 -> 512
-		th[0x15] = byte(SectorsPerTr)
-		th[0x16] = 0x52 // GAP (R/W irrelevant here but common)
-		th[0x17] = 0xE5 // filler
-
-		for s := 0; s < SectorsPerTr; s++ {
+		th[0x10] = t.Cyl  // C
+		th[0x11] = t.Head // H
+		th[0x12] = t.DataRate
+		th[0x13] = t.RecMode
+		th[0x14] = t.N
+		th[0x15] = byte(len(t.Sectors))
+		th[0x16] = t.Gap3
+		th[0x17] = t.Filler
+
+		n := 256
+		for s, sec := range t.Sectors {
 			base := 0x18 + s*8
-			th[base+0] = byte(tr)    // C
-			th[base+1] = 0x00        // H
-			th[base+2] = byte(s + 1) // R (1..9)
-			th[base+3] = 0x02        // N
-			th[base+4] = 0x00        // ST1
-			th[base+5] = 0x00        // ST2
-			th[base+6] = 0x00        // data length LE = 512
-			th[base+7] = 0x02
+			copy(th[base:], []byte{sec.C, sec.H, sec.R, sec.N, sec.ST1, sec.ST2})
+			binary.LittleEndian.PutUint16(th[base+6:], uint16(len(sec.Data))) // stored data length
+			n += len(sec.Data)
 		}
 		if _, err := w.Write(th); err != nil {
 			return err
 		}
-		for s := 0; s < SectorsPerTr; s++ {
-			if _, err := w.Write(disk.Sectors[tr][s][:]); err != nil {
+		for _, sec := range t.Sectors {
+			if _, err := w.Write(sec.Data); err != nil {
+				return err
+			}
+		}
+		if pad := int(hdr[0x34+i])*256 - n; pad > 0 {
+			if _, err := w.Write(make([]byte, pad)); err != nil {
 				return err
 			}
 		}
@@ -187,237 +641,1921 @@ func writeEDSK(w io.Writer, disk *Disk) error {
 	return nil
 }
 
-// ----- +3 filesystem builder -----
-func buildDiskFromFolder(folder string) (*Disk, error) {
-	d := &Disk{Sectors: make([][][SectorSize]byte, Tracks)}
-	for t := 0; t < Tracks; t++ {
-		d.Sectors[t] = make([][SectorSize]byte, SectorsPerTr)
-		for s := 0; s < SectorsPerTr; s++ {
-			for i := 0; i < SectorSize; i++ {
-				d.Sectors[t][s][i] = 0xE5
-			}
-		}
+// repairDir makes every extent's record count (RC) consistent with its allocation:
+// non-final extents become full (0x80, or as much as their blocks hold) and the final
+// extent is set from the +3DOS header's total length when the file has one, otherwise
+// clamped to its blocks' capacity. The corrected directory is written back and every
+// correction is reported.
+func repairDir(d *Disk) ([]string, error) {
+	dir := d.readDir()
+	entry := func(slot int) DirEntry {
+		var e DirEntry
+		copy(e[:], dir[slot*32:slot*32+32])
+		return e
 	}
-	// +3/PCW 16-byte disk spec at T0,S1
-	spec := make([]byte, 16)
-	spec[0], spec[1], spec[2], spec[3] = 0, 0, 40, 9
-	spec[4], spec[5], spec[6], spec[7] = 2, 1, 3, 2 // psh, reserved tracks, bsh, dir blocks
-	spec[8], spec[9] = 0x2A, 0x52                   // gaps (rw=2A, format=52) per +3 docs
-	copy(d.Sectors[0][0][:len(spec)], spec)
-
-	// Collect files
-	var items []FileItem
-	err := filepath.WalkDir(folder, func(path string, de fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	type key struct {
+		user byte
+		name string
+	}
+	groups := map[key][]int{} // directory slots per file
+	var keys []key
+	for slot := 0; slot < len(dir)/32; slot++ {
+		e := entry(slot)
+		if e[0] > 15 {
+			continue
 		}
-		if de.IsDir() {
-			return nil
+		k := key{e[0], e.name83()}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
 		}
-		if de.Type().IsRegular() {
-			b, err := os.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			items = append(items, FileItem{Path: path, Size: int64(len(b)), Data: b, Name83: filepath.Base(path)})
+		groups[k] = append(groups[k], slot)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].user != keys[j].user {
+			return keys[i].user < keys[j].user
 		}
-		return nil
+		return keys[i].name < keys[j].name
 	})
-	if err != nil {
-		return nil, err
-	}
 
-	sort.Slice(items, func(i, j int) bool { return strings.ToLower(items[i].Name83) < strings.ToLower(items[j].Name83) })
+	var fixes []string
+	for _, k := range keys {
+		slots := groups[k]
+		sort.SliceStable(slots, func(i, j int) bool { return entry(slots[i]).extent() < entry(slots[j]).extent() })
 
-	// 8.3 & dedupe
-	used := map[string]int{}
-	for i := range items {
-		n := to83(items[i].Name83)
-		base := strings.TrimRight(n[:8], " ")
-		ext := strings.TrimRight(n[8:], " ")
-		key := fmt.Sprintf("%-8s%-3s", base, ext)
-		if used[key] > 0 {
-			bb := []byte(fmt.Sprintf("%-8s", base))
-			sfx := used[key] % 10
-			if sfx == 0 {
-				sfx = 1
+		// The true length, when known, comes from a +3DOS header in the first block.
+		totalRecs := -1
+		if first := entry(slots[0]); first.extent() == 0 && d.Geometry.blocksOf(first)[0] != 0 {
+			if b, err := d.readBlock(d.Geometry.blocksOf(first)[0]); err == nil && isPlus3Header(b) {
+				if tl := binary.LittleEndian.Uint32(b[11:15]); tl >= 128 && int(tl) <= d.Geometry.DataBlocks()*d.Geometry.BlockSize {
+					totalRecs = (int(tl) + 127) / 128
+				}
 			}
-			bb[7] = byte('0' + sfx)
-			key = fmt.Sprintf("%-8s%-3s", string(bb), ext)
 		}
-		used[key]++
-		items[i].Name83 = key
+
+		for i, slot := range slots {
+			e := entry(slot)
+			nblocks := 0
+			for _, b := range d.Geometry.blocksOf(e) {
+				if b != 0 {
+					nblocks++
+				}
+			}
+			capRecs := min(0x80, nblocks*d.Geometry.BlockSize/128)
+			rc := int(e[15])
+			want := rc
+			switch {
+			case i < len(slots)-1:
+				want = capRecs
+			case totalRecs >= 0:
+				want = max(min(totalRecs-e.extent()*0x80, capRecs), min(1, nblocks))
+			case rc > capRecs:
+				want = capRecs
+			}
+			if want != rc {
+				dir[slot*32+15] = byte(want)
+				fixes = append(fixes, fmt.Sprintf("%s extent %d: RC 0x%02X -> 0x%02X (%d block(s))", entryName(e[:]), e.extent(), rc, want, nblocks))
+			}
+		}
+	}
+	if len(fixes) > 0 {
+		d.writeDir(dir)
 	}
+	return fixes, nil
+}
 
-	// Layout constants
-	// Directory occupies first 2 * 1KB = 4 sectors on Track 1 (S1..S4).
-	// In CP/M, allocation block numbers are absolute from the start of the data area
-	// (after reserved tracks). Thus, block 0 and 1 are the directory; first file block is 2.
-	dirSectors := DirBlocks * BlockSectors // 4 sectors = 2KB
+// ----- EDSK reader (same parser as zx3info/zx3extract) -----
+type diskType int
 
-	// Directory buffer (2KB) init to 0xE5
-	dir := make([]byte, DirBlocks*BlockSizeBytes)
-	for i := range dir {
-		dir[i] = 0xE5
-	}
-	dirIndex, maxDir := 0, len(dir)/32
+const (
+	dskUnknown diskType = iota
+	dskStandard
+	dskExtended
+)
+
+type secHeader struct {
+	C, H, R, N, ST1, ST2 byte
+	DataLen              uint16
+}
+type sector struct {
+	R        int
+	C, H, N  byte
+	ST1, ST2 byte // FDC status flags from the Track-Info sector list
+	Data     []byte
+}
+type track struct {
+	Sectors   []sector
+	ByID      map[int]*sector
+	Cyl, Head byte // as recorded in the Track-Info block
+	N         byte // Track-Info sector size code
+	// Track-Info fields; DataRate and RecMode are 0 (unknown) in older images.
+	DataRate, RecMode, Gap3, Filler byte
+}
+type disk struct {
+	kind      diskType
+	tracks    int
+	sides     int
+	trackSize []int
+	Tracks    []track // track record index (cylinder*sides + side) -> track
+}
 
-	// Capacity (in 1KB blocks) across entire data area including the 2 directory blocks
-	// Data area begins at Track 1, Sector 1.
-	totalDataSectors := (Tracks - 1) * SectorsPerTr // tracks 1..39 inclusive
-	totalBlocks := totalDataSectors / BlockSectors  // includes the 2 directory blocks (0 and 1)
+func readExactly(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
 
-	sectorAfter := func(tr, se, n int) (int, int) {
-		se += n
-		for se > SectorsPerTr {
-			se -= SectorsPerTr
-			tr++
-		}
-		return tr, se
+// dskMagics are the Disk-Info signatures of standard and extended DSK images.
+var dskMagics = [][]byte{
+	[]byte("EXTENDED CPC DSK File\r\nDisk-Info\r\n"),
+	[]byte("MV - CPCEMU Disk-File\r\nDisk-Info\r\n"),
+}
+
+// skipJunk positions f at the start of the DSK header. Stray bytes (download
+// artifacts) sometimes precede it, so the first 4KB are searched for a signature;
+// when it is not at offset 0 a warning says how many bytes were skipped.
+func skipJunk(f *os.File, path string) error {
+	buf := make([]byte, 4096)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
 	}
-	// Map absolute allocation block number -> CHS list.
-	blockToCHS := func(block int) ([]CHS, error) {
-		if block < 0 || block >= totalBlocks {
-			return nil, errors.New("block OOR")
-		}
-		// Start of data area = Track 1, Sector 1.
-		absSectors := block * BlockSectors
-		tr, se := 1, 1
-		tr, se = sectorAfter(tr, se, absSectors)
-		chs := make([]CHS, BlockSectors)
-		for i := 0; i < BlockSectors; i++ {
-			chs[i] = CHS{Track: byte(tr), Side: 0, Sect: byte(se)}
-			tr, se = sectorAfter(tr, se, 1)
+	off := -1
+	for _, m := range dskMagics {
+		if i := bytes.Index(buf[:n], m); i >= 0 && (off < 0 || i < off) {
+			off = i
 		}
-		return chs, nil
 	}
-	nextBlock := DirBlocks // first allocatable
-	writeBlock := func(block int, data []byte) error {
-		chs, err := blockToCHS(block)
-		if err != nil {
+	if off > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s: skipping %d junk byte(s) before the DSK header\n", path, off)
+	} else {
+		off = 0
+	}
+	_, err = f.Seek(int64(off), io.SeekStart)
+	return err
+}
+
+// nextTrack moves f from the end of track t's sectors (read bytes into the track) to
+// the start of the next track. That is normally size bytes in, the rest being padding,
+// but the Disk-Info size is rounded to 256 and some images get it wrong; when the next
+// Track-Info is not where size puts it, it is looked for from the end of the sectors
+// and reading resumes there, with a warning giving the discrepancy.
+func nextTrack(f *os.File, path string, t, size, read int) error {
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	magic := []byte("Track-Info\r\n")
+	if pad := size - read; pad >= 0 {
+		probe := make([]byte, len(magic))
+		if n, _ := f.ReadAt(probe, end+int64(pad)); n < len(magic) || bytes.Equal(probe, magic) {
+			_, err = f.Seek(end+int64(pad), io.SeekStart) // as the table says, or the last track
 			return err
 		}
-		off := 0
-		for _, c := range chs {
-			chunk := SectorSize
-			if off+chunk > len(data) {
-				chunk = len(data) - off
-			}
-			if chunk > 0 {
-				copy(d.Sectors[int(c.Track)][int(c.Sect-1)][:chunk], data[off:off+chunk])
-				off += chunk
-			}
+	}
+	buf := make([]byte, 0x10000)
+	n, _ := f.ReadAt(buf, end)
+	i := bytes.Index(buf[:n], magic)
+	if i < 0 {
+		if read > size {
+			fmt.Fprintf(os.Stderr, "Warning: %s: track %d holds %d bytes, more than the %d in the Disk-Info table\n", path, t, read, size)
 		}
-		return nil
+		_, err = f.Seek(end, io.SeekStart) // trust the bytes actually read
+		return err
 	}
-	putDir := func(idx int, e DirEntry) { copy(dir[idx*32:(idx+1)*32], e[:]) }
-	alloc := func(n int) ([]int, error) {
-		if nextBlock+n > totalBlocks {
-			return nil, errors.New("disk full")
+	fmt.Fprintf(os.Stderr, "Warning: %s: track %d is %d bytes in the Disk-Info table but the next Track-Info starts after %d; resynchronised there\n",
+		path, t, size, read+i)
+	_, err = f.Seek(end+int64(i), io.SeekStart)
+	return err
+}
+
+func parseDSK(path string) (*disk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := skipJunk(f, path); err != nil {
+		return nil, err
+	}
+
+	// The Disk-Info block is 256 bytes, but only 0x00..0x33 (plus the extended size
+	// table) carry data. Accept a file that ends inside the block as a minimal image
+	// with no track data instead of rejecting it outright.
+	hdr := make([]byte, 256)
+	hdrLen, err := io.ReadFull(f, hdr)
+	short := errors.Is(err, io.ErrUnexpectedEOF) && hdrLen >= 0x34
+	if err != nil && !short {
+		return nil, err
+	}
+
+	var kind diskType
+	switch {
+	case bytes.HasPrefix(hdr, []byte("EXTENDED CPC DSK File\r\nDisk-Info\r\n")):
+		kind = dskExtended
+	case bytes.HasPrefix(hdr, []byte("MV - CPCEMU Disk-File\r\nDisk-Info\r\n")):
+		kind = dskStandard
+	default:
+		return nil, errors.New("not a DSK (unknown header)")
+	}
+
+	tracks := int(hdr[0x30])
+	sides := int(hdr[0x31])
+	if tracks <= 0 || sides <= 0 {
+		return nil, fmt.Errorf("bad tracks/sides %d/%d", tracks, sides)
+	}
+
+	// Build track size table
+	total := tracks * sides
+	ts := make([]int, total)
+	if kind == dskExtended {
+		if 0x34+total > 256 || (short && 0x34+total > hdrLen) {
+			return nil, errors.New("invalid track size table")
+		}
+		for i := 0; i < total; i++ {
+			ts[i] = int(hdr[0x34+i]) * 256
 		}
-		blocks := make([]int, n)
-		for i := 0; i < n; i++ {
-			blocks[i] = nextBlock + i
+	} else {
+		sizeLE := binary.LittleEndian.Uint16(hdr[0x32:0x34])
+		if sizeLE == 0 {
+			sizeLE = 0x1300
+		}
+		for i := 0; i < total; i++ {
+			ts[i] = int(sizeLE)
 		}
-		nextBlock += n
-		return blocks, nil
 	}
 
-	for _, it := range items {
-		typ, p1, p2 := chooseHeader(it.Path)
-		h := plus3Header(it.Data, typ, p1, p2)
-		data := append(h, it.Data...)
-		total := len(data)
+	d := &disk{kind: kind, tracks: tracks, sides: sides, trackSize: ts, Tracks: make([]track, total)}
+	if short {
+		return d, nil // header-only image: every track unformatted
+	}
 
-		if dirIndex >= maxDir {
-			fmt.Fprintf(os.Stderr, "Directory full; skipping %s\n", it.Path)
+	// Read tracks one by one using sizes
+	for t := 0; t < total; t++ {
+		size := ts[t]
+		if size == 0 {
+			// Unformatted/missing track: skip
 			continue
 		}
-		if total == 0 {
-			putDir(dirIndex, makeDirEntry(it.Name83, 0, 0, nil))
-			dirIndex++
-			continue
+		th, err := readExactly(f, 256)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %w", t, err)
 		}
-
-		var pos int
-		extentNo := 0
-		for pos < total {
-			remain := total - pos
-			bytesThis := remain
-			if bytesThis > 16*1024 {
-				bytesThis = 16 * 1024
+		if !bytes.HasPrefix(th, []byte("Track-Info\r\n")) {
+			return nil, fmt.Errorf("track %d: missing Track-Info header", t)
+		}
+		secCount := int(th[0x15])
+		if secCount <= 0 {
+			return nil, fmt.Errorf("track %d: bad sector count", t)
+		}
+		off := 0x18
+		headers := make([]secHeader, secCount)
+		for i := 0; i < secCount; i++ {
+			headers[i] = secHeader{
+				C: th[off+0], H: th[off+1], R: th[off+2], N: th[off+3],
+				ST1: th[off+4], ST2: th[off+5],
+				DataLen: binary.LittleEndian.Uint16(th[off+6 : off+8]),
+			}
+			off += 8
+		}
+		trk := track{
+			Sectors: make([]sector, secCount), ByID: map[int]*sector{},
+			Cyl: th[0x10], Head: th[0x11], N: th[0x14],
+			DataRate: th[0x12], RecMode: th[0x13], Gap3: th[0x16], Filler: th[0x17],
+		}
+		read := 256
+		for i := 0; i < secCount; i++ {
+			want := int(headers[i].DataLen)
+			if want == 0 {
+				want = 128 << headers[i].N
 			}
-			need := (bytesThis + BlockSizeBytes - 1) / BlockSizeBytes
-			blocks, err := alloc(need)
+			if want < 0 {
+				return nil, fmt.Errorf("track %d sector %d: bad length", t, i+1)
+			}
+			payload, err := readExactly(f, want)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Disk full; truncating %s\n", it.Path)
-				break
+				return nil, fmt.Errorf("track %d: %w", t, err)
 			}
-			for i, b := range blocks {
-				start := pos + i*BlockSizeBytes
-				end := start + BlockSizeBytes
+			read += want
+			trk.Sectors[i] = sector{
+				R: int(headers[i].R), C: headers[i].C, H: headers[i].H, N: headers[i].N,
+				ST1: headers[i].ST1, ST2: headers[i].ST2, Data: payload,
+			}
+			trk.ByID[int(headers[i].R)] = &trk.Sectors[i]
+		}
+		if err := nextTrack(f, path, t, size, read); err != nil {
+			return nil, fmt.Errorf("track %d: %w", t, err)
+		}
+		// Keep the record order: cylinder-major, side 0 before side 1 (SS: t==cyl)
+		d.Tracks[t] = trk
+	}
+
+	return d, nil
+}
+
+// spec returns the first 16 bytes of the lowest-numbered sector of the first track,
+// where a +3 or PCW disk keeps its specification, or nil if that track is empty.
+func (pd *disk) spec() []byte {
+	if len(pd.Tracks) == 0 || len(pd.Tracks[0].Sectors) == 0 {
+		return nil
+	}
+	first := &pd.Tracks[0].Sectors[0]
+	for i := range pd.Tracks[0].Sectors {
+		if sec := &pd.Tracks[0].Sectors[i]; sec.R < first.R {
+			first = sec
+		}
+	}
+	if len(first.Data) < 16 {
+		return nil
+	}
+	return first.Data[:16]
+}
+
+// trackLayouts describes every track of a parsed image as it was stored, for a
+// faithful copy: sector order, IDs, sizes, status flags and gaps are all kept.
+func (pd *disk) trackLayouts() []TrackLayout {
+	out := make([]TrackLayout, len(pd.Tracks))
+	for t, trk := range pd.Tracks {
+		tl := TrackLayout{Cyl: trk.Cyl, Head: trk.Head, DataRate: trk.DataRate, RecMode: trk.RecMode,
+			N: trk.N, Gap3: trk.Gap3, Filler: trk.Filler}
+		for _, sec := range trk.Sectors {
+			tl.Sectors = append(tl.Sectors, SectorLayout{C: sec.C, H: sec.H, R: byte(sec.R), N: sec.N,
+				ST1: sec.ST1, ST2: sec.ST2, Data: sec.Data})
+		}
+		out[t] = tl
+	}
+	return out
+}
+
+// EachSector calls fn for every sector of a parsed image in physical order, the order
+// the image stores them: track record by track record, and within a track in the order
+// of its sector list. cyl, head and r are the sector's own ID fields and st1 and st2 the
+// FDC status flags recorded for it, so an emulator can feed a controller model the disk
+// as it was dumped. data aliases the parsed sector.
+func (pd *disk) EachSector(fn func(cyl, head, r int, data []byte, st1, st2 byte)) {
+	for _, trk := range pd.Tracks {
+		for _, sec := range trk.Sectors {
+			fn(int(sec.C), int(sec.H), sec.R, sec.Data, sec.ST1, sec.ST2)
+		}
+	}
+}
+
+// loadDisk parses an existing image and copies its sectors into the writable
+// model. Only images laid out like one of the KnownGeometries are accepted; a valid
+// spec at T0,S1 then supplies the reserved tracks, block size and directory blocks,
+// so a disk formatted elsewhere with, say, 2KB blocks is read the way it was written.
+func loadDisk(path string) (*Disk, error) {
+	pd, err := parseDSK(path)
+	if err != nil {
+		return nil, err
+	}
+	var g Geometry
+	for _, k := range KnownGeometries {
+		if pd.tracks == k.Tracks && pd.sides == k.Sides {
+			g = k
+			break
+		}
+	}
+	if g.Tracks == 0 {
+		return nil, fmt.Errorf("unsupported geometry %d tracks/%d sides (need 40/1 or 80/2)", pd.tracks, pd.sides)
+	}
+	if spec := pd.spec(); looksPlus3Spec(spec) && int(spec[5]) < g.Tracks*g.Sides && spec[7] <= 16 {
+		g.Type, g.Sidedness, g.ReservedTracks = spec[0], spec[1], int(spec[5])
+		g.BlockSize, g.DirBlocks = 128<<spec[6], int(spec[7])
+	}
+	n := g.Tracks * g.Sides
+	d := &Disk{Sectors: make([][][SectorSize]byte, n), Geometry: g, DataRate: pd.Tracks[0].DataRate, RecMode: pd.Tracks[0].RecMode}
+	d.Compat = compatProfiles["zx3dsk"]
+	d.Compat.Gap3, d.Compat.Filler = pd.Tracks[0].Gap3, pd.Tracks[0].Filler
+	d.Source = pd.trackLayouts()
+	bases := sectorBases(d.Source)
+	for t := 0; t < n; t++ {
+		d.Sectors[t] = make([][SectorSize]byte, g.SectorsPerTrack)
+		// Sector IDs run up from the track's base (see sectorBases). Saving keeps the IDs.
+		for s := 1; s <= g.SectorsPerTrack; s++ {
+			id := bases[t] + s - 1
+			sec := pd.Tracks[t].ByID[id]
+			if sec == nil {
+				return nil, fmt.Errorf("missing sector T%d R%d", t, id)
+			}
+			if len(sec.Data) != SectorSize {
+				return nil, fmt.Errorf("sector T%d R%d len=%d (need %d)", t, id, len(sec.Data), SectorSize)
+			}
+			copy(d.Sectors[t][s-1][:], sec.Data)
+		}
+	}
+	return d, nil
+}
+
+// sectorBases gives the sector ID each track's sectors run up from, the one loadDisk
+// stores first. That is 1 on +3 disks but 0 or 0x41 on some CPC and PCW formats, and is
+// settled once for the disk as the lowest ID most tracks share among those whose IDs run
+// without a gap. A track keeps a base of its own only when its IDs are a full gapless run
+// as long as the disk's; one that lost or renamed a sector takes the disk's base, so the
+// sector that is gone is reported rather than every later one shifting down by one.
+func sectorBases(tracks []TrackLayout) []int {
+	type run struct{ lo, n int }
+	runs := make([]run, len(tracks))
+	count := map[run]int{}
+	best := run{1, 0}
+	for tr, t := range tracks {
+		ids := map[byte]bool{}
+		lo, hi := 255, 0
+		for _, sec := range t.Sectors {
+			ids[sec.R] = true
+			lo, hi = min(lo, int(sec.R)), max(hi, int(sec.R))
+		}
+		if len(ids) == 0 || hi-lo+1 != len(ids) {
+			continue
+		}
+		runs[tr] = run{lo, len(ids)}
+		count[runs[tr]]++
+		if count[runs[tr]] > count[best] {
+			best = runs[tr]
+		}
+	}
+	bases := make([]int, len(tracks))
+	for tr, r := range runs {
+		bases[tr] = best.lo
+		if r.n != 0 && r.n == best.n {
+			bases[tr] = r.lo
+		}
+	}
+	return bases
+}
+
+// ----- block/CHS mapping -----
+// Block numbers are absolute from the start of the data area (the first sector after
+// the reserved tracks), so the directory occupies blocks 0..DirBlocks-1.
+
+// blockToCHS maps an allocation block number to the sectors holding it.
+func (g Geometry) blockToCHS(block int) ([]CHS, error) {
+	if block < 0 || block >= g.DataBlocks() {
+		return nil, errors.New("block OOR")
+	}
+	chs := make([]CHS, g.BlockSectors())
+	for i := range chs {
+		chs[i] = g.locate(block*g.BlockSectors() + i)
+	}
+	return chs, nil
+}
+
+// sector returns the storage of the sector at c.
+func (d *Disk) sector(c CHS) *[SectorSize]byte {
+	return &d.Sectors[int(c.Track)*d.Geometry.Sides+int(c.Side)][int(c.Sect-1)]
+}
+
+func (d *Disk) writeBlock(block int, data []byte) error {
+	chs, err := d.Geometry.blockToCHS(block)
+	if err != nil {
+		return err
+	}
+	off := 0
+	for _, c := range chs {
+		chunk := SectorSize
+		if off+chunk > len(data) {
+			chunk = len(data) - off
+		}
+		if chunk > 0 {
+			copy(d.sector(c)[:chunk], data[off:off+chunk])
+			off += chunk
+		}
+	}
+	return nil
+}
+
+func (d *Disk) readBlock(block int) ([]byte, error) {
+	chs, err := d.Geometry.blockToCHS(block)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, d.Geometry.BlockSize)
+	for _, c := range chs {
+		out = append(out, d.sector(c)[:]...)
+	}
+	return out, nil
+}
+
+// readDir returns a copy of the directory blocks (on a 180K disk, T1 S1..S4).
+func (d *Disk) readDir() []byte {
+	dir := make([]byte, 0, d.Geometry.DirSize())
+	for b := 0; b < d.Geometry.DirBlocks; b++ {
+		blk, _ := d.readBlock(b)
+		dir = append(dir, blk...)
+	}
+	return dir
+}
+
+// writeDir stores a directory buffer back into the directory blocks.
+func (d *Disk) writeDir(dir []byte) {
+	for b := 0; b < d.Geometry.DirBlocks; b++ {
+		_ = d.writeBlock(b, dir[b*d.Geometry.BlockSize:])
+	}
+}
+
+// ----- +3 filesystem builder -----
+
+// newFormattedDisk returns a freshly formatted 180K +3 disk: every sector filled with
+// 0xE5 (which also leaves the directory empty) and the 16-byte disk spec at T0,S1.
+func newFormattedDisk() *Disk {
+	return newBlankDisk(Plus3Geometry)
+}
+
+// newBlankDisk formats a disk with geometry g. Double-sided tracks are stored
+// side 0 first, as EDSK lays them out.
+func newBlankDisk(g Geometry) *Disk {
+	n := g.Tracks * g.Sides
+	d := &Disk{Sectors: make([][][SectorSize]byte, n), Geometry: g, DataRate: rateDD, RecMode: modeMFM, Compat: compatProfiles["zx3dsk"]}
+	for t := 0; t < n; t++ {
+		d.Sectors[t] = make([][SectorSize]byte, g.SectorsPerTrack)
+		for s := range d.Sectors[t] {
+			for i := 0; i < SectorSize; i++ {
+				d.Sectors[t][s][i] = 0xE5
+			}
+		}
+	}
+	copy(d.Sectors[0][0][:16], g.Spec())
+	return d
+}
+
+// headerParams are the +3DOS header fields a build needs to regenerate a header.
+type headerParams struct {
+	Type   byte `json:"type"`
+	Param1 int  `json:"param1"`
+	Param2 int  `json:"param2"`
+}
+
+// sidecar is the part of a zx3extract -meta file that describes a catalog entry.
+type sidecar struct {
+	User       int           `json:"user"`
+	Name       string        `json:"name"`
+	Ext        string        `json:"ext"`
+	ReadOnly   bool          `json:"read_only"`
+	System     bool          `json:"system"`
+	Archive    bool          `json:"archive"`
+	Plus3      *headerParams `json:"plus3_header"`
+	HeaderKept bool          `json:"header_kept"`
+}
+
+// isSidecar reports whether path is a file zx3extract wrote beside another file in the
+// same folder: its -meta JSON (see readSidecar), or the 128-byte copy of its +3DOS
+// header that -hdr and -split-header write. Anything else is an ordinary file.
+func isSidecar(path string) bool {
+	ext := filepath.Ext(path)
+	owner := strings.TrimSuffix(path, ext)
+	if st, err := os.Stat(owner); err != nil || !st.Mode().IsRegular() {
+		return false
+	}
+	switch ext {
+	case ".json":
+		sc, _ := readSidecar(owner)
+		return sc != nil
+	case ".hdr", ".p3h":
+		b, err := os.ReadFile(path)
+		return err == nil && len(b) == 128 && isPlus3Header(b)
+	}
+	return false
+}
+
+// readSidecar reads path+".json" when it is the zx3extract -meta file for path: one
+// naming path's own file as its output_name and listing the file's extents. It returns
+// nil if there is no such file or the JSON is something else, which is then built like
+// any other file.
+func readSidecar(path string) (*sidecar, error) {
+	js, err := os.ReadFile(path + ".json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m struct {
+		sidecar
+		OutputName string            `json:"output_name"`
+		Extents    []json.RawMessage `json:"extents"`
+	}
+	if json.Unmarshal(js, &m) != nil || m.OutputName != filepath.Base(path) || len(m.Extents) == 0 {
+		return nil, nil
+	}
+	return &m.sidecar, nil
+}
+
+// applySidecar restores the user number, attributes, name and header handling recorded
+// in the -meta file for it, if there is one, so an extracted folder rebuilds to the
+// same catalog. The sidecar used is added to it.Sidecars.
+func applySidecar(it *FileItem) error {
+	sc, err := readSidecar(it.Path)
+	if err != nil || sc == nil {
+		return err
+	}
+	if sc.User < 0 || sc.User > 15 {
+		return fmt.Errorf("%s.json: user %d out of range 0..15", it.Path, sc.User)
+	}
+	it.Sidecars = append(it.Sidecars, it.Path+".json")
+	it.User = byte(sc.User)
+	if sc.Name != "" {
+		it.Name83 = sc.Name
+		if sc.Ext != "" {
+			it.Name83 += "." + sc.Ext
+		}
+	}
+	it.Attr = 0
+	for i, on := range []bool{sc.ReadOnly, sc.System, sc.Archive} {
+		if on {
+			it.Attr |= 1 << i
+		}
+	}
+	switch {
+	case sc.HeaderKept || sc.Plus3 == nil:
+		// Either the file still carries its header or it never had one.
+		it.Raw = true
+	default:
+		it.Plus3 = sc.Plus3
+	}
+	return nil
+}
+
+// loadRenameMap reads a -rename-map file: a JSON object, or CSV rows of
+// source,name (# starts a comment), mapping source paths to 8.3 names. A source is
+// a path relative to the input folder, with forward slashes, or a bare file name.
+// Every name must survive to83 unchanged apart from case.
+func loadRenameMap(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	} else {
+		cr := csv.NewReader(bytes.NewReader(b))
+		cr.Comment, cr.FieldsPerRecord, cr.TrimLeadingSpace = '#', 2, true
+		rows, err := cr.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, row := range rows {
+			m[row[0]] = row[1]
+		}
+	}
+	var bad []string
+	for src, name := range m {
+		if shown, ok := exact83(name); !ok {
+			bad = append(bad, fmt.Sprintf("%s -> %q (would become %s)", src, name, shown))
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return nil, fmt.Errorf("%s: not valid 8.3 names: %s", path, strings.Join(bad, "; "))
+	}
+	return m, nil
+}
+
+// exact83 reports whether name survives to83 unchanged apart from case, and returns
+// the NAME.EXT it would become.
+func exact83(name string) (string, bool) {
+	n := to83(name)
+	shown := strings.TrimRight(n[:8], " ")
+	if ext := strings.TrimRight(n[8:], " "); ext != "" {
+		shown += "." + ext
+	}
+	return shown, strings.ToUpper(name) == shown
+}
+
+// manifestFile is one file of a -from manifest: the catalog entry, as in a -meta
+// sidecar, and where its bytes are. Data is a path relative to the manifest; when it
+// is empty output_name is used, so zx3extract -manifest-only output can be fed back.
+type manifestFile struct {
+	sidecar
+	Data       string `json:"data"`
+	OutputName string `json:"output_name"`
+}
+
+// loadManifest reads a -from manifest, {"files": [...]}, into items in manifest order.
+// Every name must be a valid 8.3 name and unique within its user area. A file with a
+// plus3_header gets exactly that header; one without is stored as it is, headerless
+// or (with header_kept) already carrying its header.
+func loadManifest(path string) ([]FileItem, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Files []manifestFile `json:"files"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var items []FileItem
+	seen := map[string]bool{}
+	for i, f := range m.Files {
+		src := f.Data
+		if src == "" {
+			src = f.OutputName
+		}
+		if src == "" {
+			return nil, fmt.Errorf("%s: file %d gives no data path", path, i+1)
+		}
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(filepath.Dir(path), src)
+		}
+		if f.User < 0 || f.User > 15 {
+			return nil, fmt.Errorf("%s: %s: user %d out of range 0..15", path, src, f.User)
+		}
+		name := f.Name
+		if f.Ext != "" {
+			name += "." + f.Ext
+		}
+		shown, ok := exact83(name)
+		if f.Name == "" || !ok {
+			return nil, fmt.Errorf("%s: %s: %q is not a valid 8.3 name (would become %s)", path, src, name, shown)
+		}
+		key := fmt.Sprintf("%d:%s", f.User, shown)
+		if seen[key] {
+			return nil, fmt.Errorf("%s: %s appears twice in user %d", path, shown, f.User)
+		}
+		seen[key] = true
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		it := FileItem{Path: src, Size: int64(len(data)), Data: data, Name83: to83(name), Fixed: true, User: byte(f.User)}
+		for bit, on := range []bool{f.ReadOnly, f.System, f.Archive} {
+			if on {
+				it.Attr |= 1 << bit
+			}
+		}
+		if f.Plus3 != nil && !f.HeaderKept {
+			it.Plus3 = f.Plus3
+		} else {
+			it.Raw = true
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+// collectFolder reads every regular file below folder and assigns unique 8.3 names.
+// zx3extract sidecars (see isSidecar) are not stored; a -meta file is applied to the
+// file it describes.
+// Files named in renames get exactly the mapped name; the others are named
+// automatically, steering clear of the mapped names. The returned notes report
+// automatic names changed to avoid a mapped one and map entries that matched no file.
+// Files go in CP/M user area user unless a sidecar says otherwise.
+func collectFolder(folder string, renames map[string]string, user byte) ([]FileItem, []string, error) {
+	var items []FileItem
+	err := filepath.WalkDir(folder, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+		if de.Type().IsRegular() && !isSidecar(path) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			it := FileItem{Path: path, Size: int64(len(b)), Data: b, Name83: filepath.Base(path), User: user}
+			if err := applySidecar(&it); err != nil {
+				return err
+			}
+			for _, ext := range []string{".hdr", ".p3h"} {
+				if isSidecar(path + ext) {
+					it.Sidecars = append(it.Sidecars, path+ext)
+				}
+			}
+			items = append(items, it)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(items, func(i, j int) bool { return strings.ToLower(items[i].Name83) < strings.ToLower(items[j].Name83) })
+
+	// Mapped names first, so automatic names can keep out of their way.
+	var notes []string
+	used := map[string]int{}
+	mappedBy := map[string]string{}
+	matched := map[string]bool{}
+	for i := range items {
+		rel, _ := filepath.Rel(folder, items[i].Path)
+		src := filepath.ToSlash(rel)
+		name, ok := renames[src]
+		if !ok {
+			src = filepath.Base(items[i].Path)
+			name, ok = renames[src]
+		}
+		if !ok {
+			continue
+		}
+		matched[src] = true
+		items[i].Name83, items[i].Fixed = to83(name), true
+		ukey := fmt.Sprintf("%d:%s", items[i].User, items[i].Name83)
+		if other, dup := mappedBy[ukey]; dup {
+			return nil, nil, fmt.Errorf("rename map gives %s and %s the same name %s", other, items[i].Path, name)
+		}
+		mappedBy[ukey] = items[i].Path
+		used[ukey]++
+	}
+	for src := range renames {
+		if !matched[src] {
+			notes = append(notes, fmt.Sprintf("rename map entry %s matches no file", src))
+		}
+	}
+	sort.Strings(notes)
+
+	// 8.3 & dedupe (names only clash within one user area)
+	for i := range items {
+		if items[i].Fixed {
+			continue
+		}
+		n := to83(items[i].Name83)
+		base := strings.TrimRight(n[:8], " ")
+		ext := strings.TrimRight(n[8:], " ")
+		key := fmt.Sprintf("%-8s%-3s", base, ext)
+		ukey := fmt.Sprintf("%d:%s", items[i].User, key)
+		if used[ukey] > 0 {
+			user := items[i].User
+			key = aliasName(base, ext, items[i].Path, func(k string) bool { return used[fmt.Sprintf("%d:%s", user, k)] > 0 })
+			if other, clash := mappedBy[ukey]; clash {
+				notes = append(notes, fmt.Sprintf("%s: automatic name %s.%s is mapped to %s; using %s",
+					items[i].Path, base, ext, other, entryName(append([]byte{0}, key...))))
+			}
+			ukey = fmt.Sprintf("%d:%s", items[i].User, key)
+		}
+		used[ukey]++
+		items[i].Name83 = key
+	}
+	return items, notes, nil
+}
+
+// reportSidecars prints, for each item, the zx3extract sidecars that were applied to
+// it or left out of the build as copies of its header.
+func reportSidecars(items []FileItem) {
+	for _, it := range items {
+		for _, sc := range it.Sidecars {
+			if filepath.Ext(sc) == ".json" {
+				fmt.Printf("Sidecar %s applied to %s\n", sc, it.Path)
+			} else {
+				fmt.Printf("Sidecar %s is the header of %s; not stored\n", sc, it.Path)
+			}
+		}
+	}
+}
+
+// aliasName makes a Windows-style short name for a file whose 8.3 name is taken:
+// the first six characters of base and ~1..~9, then, once those run out, the first
+// two characters, four hex digits of a hash of the source path and ~1, so files
+// sharing a long prefix stay distinct and recognisable. taken reports whether an
+// 11-character NAME+EXT key is already in use.
+func aliasName(base, ext, src string, taken func(string) bool) string {
+	for n := 1; n <= 9; n++ {
+		k := fmt.Sprintf("%-8s%-3s", fmt.Sprintf("%s~%d", base[:min(6, len(base))], n), ext)
+		if !taken(k) {
+			return k
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(src))
+	sum := h.Sum32()
+	for i := uint32(0); ; i++ {
+		k := fmt.Sprintf("%-8s%-3s", fmt.Sprintf("%s%04X~1", base[:min(2, len(base))], (sum+i)&0xFFFF), ext)
+		if !taken(k) {
+			return k
+		}
+	}
+}
+
+// readFiles reassembles every file on a disk, keeping the raw bytes (including any
+// +3DOS header), user number, attribute bits, block numbers and CP/M 3 datestamps,
+// ready to be fed back into a Builder.
+func readFiles(d *Disk, label string) ([]FileItem, error) {
+	type key struct {
+		user byte
+		name string
+	}
+	groups := map[key][]DirEntry{}
+	stamps := map[key]*[8]byte{}
+	var keys []key
+	dir := d.readDir()
+	for i := 0; i+32 <= len(dir); i += 32 {
+		var e DirEntry
+		copy(e[:], dir[i:i+32])
+		if e[0] > 15 { // 0xE5 = deleted/unused
+			continue
+		}
+		k := key{e[0], e.name83()}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], e)
+		// the SFCB closing this group of four entries stamps the file's first extent
+		slot, sfcb := i/32, (i/32|3)*32
+		if e.extent() == 0 && slot%4 != 3 && sfcb+32 <= len(dir) && dir[sfcb] == 0x21 {
+			var st [8]byte
+			copy(st[:], dir[sfcb+1+slot%4*10:])
+			if st != [8]byte{} {
+				stamps[k] = &st
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].user != keys[j].user {
+			return keys[i].user < keys[j].user
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	var items []FileItem
+	for _, k := range keys {
+		var exts []DirEntry
+		sorted := groups[k]
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].extent() < sorted[j].extent() })
+		for _, e := range sorted {
+			// duplicate extent: keep the higher RC, or the later directory slot on a tie
+			if n := len(exts); n > 0 && exts[n-1].extent() == e.extent() {
+				if e[15] >= exts[n-1][15] {
+					exts[n-1] = e
+				}
+				continue
+			}
+			exts = append(exts, e)
+		}
+		var data []byte
+		var blocks []int
+		for _, e := range exts {
+			want := (int(e[12]&d.Geometry.extentMask())*128 + int(e[15])) * 128
+			for _, b := range d.Geometry.blocksOf(e) {
+				if b == 0 || want <= 0 {
+					continue
+				}
+				blk, err := d.readBlock(b)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", entryName(e[:]), err)
+				}
+				n := min(want, d.Geometry.BlockSize)
+				data = append(data, blk[:n]...)
+				blocks = append(blocks, b)
+				want -= n
+			}
+		}
+		items = append(items, FileItem{
+			Name83: k.name, Path: label + ":" + entryName(exts[0][:]),
+			Size: int64(len(data)), Data: data,
+			User: k.user, Attr: exts[0].attr(), Raw: true, Blocks: blocks,
+			Stamps: stamps[k],
+		})
+	}
+	return items, nil
+}
+
+// AllocStrategy chooses n free blocks for the next extent of a file. used marks
+// the blocks already taken and first is the lowest block that may be handed out. It returns nil when the disk cannot supply n blocks.
+type AllocStrategy func(used []bool, first, n int) []int
+
+// SequentialAlloc hands out the lowest free blocks, so each file occupies a
+// contiguous run where possible. It is the default strategy.
+func SequentialAlloc(used []bool, first, n int) []int {
+	var blocks []int
+	for b := first; b < len(used) && len(blocks) < n; b++ {
+		if !used[b] {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) < n {
+		return nil
+	}
+	return blocks
+}
+
+// InterleavedAlloc leaves a free block between consecutive blocks of an extent,
+// giving a loader time to process one block before the next reaches the head.
+// The gaps are filled by later files; when the disk gets too full to keep the
+// spacing it falls back to any free block.
+func InterleavedAlloc(used []bool, first, n int) []int {
+	var blocks []int
+	taken := make(map[int]bool)
+	for b := first; b < len(used) && len(blocks) < n; b++ {
+		if used[b] || (len(blocks) > 0 && b == blocks[len(blocks)-1]+1) {
+			continue
+		}
+		blocks = append(blocks, b)
+		taken[b] = true
+	}
+	for b := first; b < len(used) && len(blocks) < n; b++ {
+		if !used[b] && !taken[b] {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) < n {
+		return nil
+	}
+	return blocks
+}
+
+var errDiskFull = errors.New("disk full")
+
+// allocStrategies maps the -alloc flag values to their strategies.
+var allocStrategies = map[string]AllocStrategy{
+	"sequential":  SequentialAlloc,
+	"interleaved": InterleavedAlloc,
+}
+
+// markRaw flags the items matching any of the comma-separated glob patterns as Raw,
+// so Build writes them without a +3DOS header. It returns the number of items marked.
+func markRaw(items []FileItem, globs string) (int, error) {
+	return markMatching(items, globs, func(it *FileItem) { it.Raw = true })
+}
+
+// markAttr sets the attribute bits attr (attrReadOnly, attrSystem, attrArchive) on the
+// items matching globs, on top of any a sidecar gave them.
+func markAttr(items []FileItem, globs string, attr byte) (int, error) {
+	return markMatching(items, globs, func(it *FileItem) { it.Attr |= attr })
+}
+
+// markMatching calls mark for each item matching any of the comma-separated glob
+// patterns. A pattern matches either the source file name or the 8.3 name, ignoring
+// case. It returns the number of items marked.
+func markMatching(items []FileItem, globs string, mark func(*FileItem)) (int, error) {
+	var pats []string
+	for _, p := range strings.Split(globs, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return 0, fmt.Errorf("bad pattern %q: %v", p, err)
+		}
+		pats = append(pats, strings.ToUpper(p))
+	}
+	n := 0
+	for i := range items {
+		src := strings.ToUpper(filepath.Base(items[i].Path))
+		for _, p := range pats {
+			m1, _ := filepath.Match(p, src)
+			m2, _ := filepath.Match(p, strings.ToUpper(items[i].Name83))
+			if m1 || m2 {
+				mark(&items[i])
+				n++
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// Builder lays files out on a freshly formatted disk.
+type Builder struct {
+	// FirstBlock is the first allocation block handed out to files; blocks below it
+	// are left unused. Zero means the first block after the directory.
+	FirstBlock int
+	// KeepLayout places items that carry source block numbers (FileItem.Blocks) on
+	// exactly those blocks, so a source disk's block layout is reproduced.
+	KeepLayout bool
+	// Alloc decides which free blocks each extent gets; nil means SequentialAlloc.
+	Alloc AllocStrategy
+	// Verify reads every written block back after the build and fails on a mismatch.
+	Verify bool
+	// Geometry is the layout of the new disk; the zero value means Plus3Geometry.
+	Geometry Geometry
+	// Label, when set, is written as a CP/M 3 disk label in the first directory entry.
+	Label string
+	// Stamp, when not zero, turns on CP/M 3 datestamps: every fourth directory entry
+	// holds the stamps of the three before it, and every file that carries no Stamps of
+	// its own gets Stamp as its create and update time. A label (blank unless Label is
+	// set) enables them.
+	Stamp time.Time
+	// Stamped turns on CP/M 3 datestamps as Stamp does, but leaves the stamps of
+	// files that carry none of their own blank rather than inventing a time.
+	Stamped bool
+	// TraceAlloc, when not nil, receives a log of every file's block allocations, the
+	// sectors each block maps to and the directory entries written.
+	TraceAlloc io.Writer
+	// Dedup stores the on-disk bytes of identical files once: a later copy gets its own
+	// directory entries listing the first copy's blocks. CP/M assumes each block has one
+	// owner, so erasing or rewriting either file elsewhere damages the other.
+	Dedup bool
+	// AlignTrack starts every file on the first block of a track, leaving the free
+	// blocks before it unused, so a loader can reach the file with a single seek.
+	AlignTrack bool
+}
+
+// payload returns the bytes stored on disk for it: the data behind a +3DOS header
+// unless it is Raw, in which case the last record is filled with ^Z as CP/M does,
+// since no header records the length.
+func (it FileItem) payload() []byte {
+	switch {
+	case it.Raw:
+		if tail := len(it.Data) % 128; tail != 0 {
+			return append(append([]byte(nil), it.Data...), bytes.Repeat([]byte{0x1A}, 128-tail)...)
+		}
+		return it.Data
+	case it.Plus3 != nil:
+		return append(plus3Header(it.Data, it.Plus3.Type, it.Plus3.Param1, it.Plus3.Param2), it.Data...)
+	}
+	typ, p1, p2 := chooseHeader(it.Path)
+	return append(plus3Header(it.Data, typ, p1, p2), it.Data...)
+}
+
+// stamp returns the datestamp given to entries that carry none of their own: Stamp,
+// or a blank one when Stamped turns datestamps on without it.
+func (bld *Builder) stamp() [4]byte {
+	if bld.Stamp.IsZero() {
+		return [4]byte{}
+	}
+	return cpmStamp(bld.Stamp)
+}
+
+// Build writes items to a new disk, adding a +3DOS header to every item that is not Raw.
+func (bld *Builder) Build(items []FileItem) (*Disk, error) {
+	g := bld.Geometry
+	if g.Tracks == 0 {
+		g = Plus3Geometry
+	}
+	// Every directory entry is written as one 16KB extent: sixteen 8-bit numbers of 1KB
+	// blocks, or eight 16-bit numbers of 2KB blocks on disks of more than 256 blocks.
+	if g.extentMask() != 0 {
+		return nil, fmt.Errorf("geometry %s: building files needs %dKB blocks", g.Name, 16/g.entryBlocks())
+	}
+	d := newBlankDisk(g)
+
+	// In CP/M, allocation block numbers are absolute from the start of the data area
+	// (after reserved tracks). Thus, blocks 0..DirBlocks-1 are the directory.
+	totalBlocks := g.DataBlocks()
+
+	// Directory buffer init to 0xE5
+	dir := make([]byte, g.DirSize())
+	for i := range dir {
+		dir[i] = 0xE5
+	}
+	dirIndex, maxDir := 0, g.DirEntries()
+	stamped := bld.Stamped || !bld.Stamp.IsZero()
+	isStampSlot := func(slot int) bool { return stamped && slot%4 == 3 }
+	nextSlot := func() {
+		if dirIndex++; isStampSlot(dirIndex) {
+			dirIndex++
+		}
+	}
+	slotsFit := func(n int) bool { // n more file entries fit from dirIndex on
+		for i := dirIndex; i < maxDir && n > 0; i++ {
+			if !isStampSlot(i) {
+				n--
+			}
+		}
+		return n == 0
+	}
+
+	firstBlock := g.DirBlocks // first allocatable
+	if bld.FirstBlock != 0 {
+		if bld.FirstBlock < g.DirBlocks || bld.FirstBlock >= totalBlocks {
+			return nil, fmt.Errorf("first block %d outside %d..%d", bld.FirstBlock, g.DirBlocks, totalBlocks-1)
+		}
+		firstBlock = bld.FirstBlock
+	}
+	strategy := bld.Alloc
+	if strategy == nil {
+		strategy = SequentialAlloc
+	}
+	used := make([]bool, totalBlocks)
+	if bld.KeepLayout {
+		for _, it := range items {
+			for _, b := range it.Blocks {
+				if b < g.DirBlocks || b >= totalBlocks {
+					return nil, fmt.Errorf("%s: block %d outside the data area", it.Path, b)
+				}
+				if used[b] {
+					return nil, fmt.Errorf("%s: block %d is claimed by more than one file", it.Path, b)
+				}
+				used[b] = true
+			}
+		}
+	}
+	written := map[int][]byte{} // block -> bytes written, for Verify
+	trace := func(format string, a ...any) {
+		if bld.TraceAlloc != nil {
+			fmt.Fprintf(bld.TraceAlloc, format, a...)
+		}
+	}
+	fileStamps := make([]*[8]byte, maxDir) // slot -> stamps carried by the item written there
+	var itemStamps *[8]byte
+	putDir := func(idx int, e DirEntry) {
+		copy(dir[idx*32:(idx+1)*32], e[:])
+		if e[0] <= 15 {
+			fileStamps[idx] = itemStamps
+		}
+		var blocks []int
+		for _, b := range g.blocksOf(e) {
+			if b != 0 {
+				blocks = append(blocks, b)
+			}
+		}
+		trace("  dir slot %d: user %d %s EX=%d S1=%d S2=%d RC=%d blocks %v\n",
+			idx, e[0], entryName(e[:]), e[12], e[13], e[14], e[15], blocks)
+	}
+	alloc := func(n int) ([]int, error) {
+		blocks := strategy(used, firstBlock, n)
+		if len(blocks) < n {
+			return nil, errDiskFull
+		}
+		for _, b := range blocks[:n] {
+			if b < firstBlock || b >= totalBlocks || used[b] {
+				return nil, fmt.Errorf("allocation strategy returned unusable block %d", b)
+			}
+			used[b] = true
+		}
+		return blocks[:n], nil
+	}
+
+	// aligned reports whether block b is the first block of a track; on the 180K +3
+	// format a track holds 4.5 blocks, so that is every ninth block.
+	trackBytes := g.SectorsPerTrack * g.SectorSize
+	aligned := func(b int) bool { return b*g.BlockSize%trackBytes == 0 }
+	padBlocks := 0 // blocks given up to AlignTrack
+
+	type storedFile struct {
+		path    string
+		data    []byte
+		extents [][]int
+	}
+	stored := map[[sha256.Size]byte]storedFile{} // payload hash -> first copy, for Dedup
+
+	if bld.Label != "" || stamped {
+		e := labelEntry(bld.Label)
+		if stamped {
+			e[12] |= 0x30 // create and update stamps
+			st := bld.stamp()
+			copy(e[24:28], st[:])
+			copy(e[28:32], st[:])
+		}
+		putDir(dirIndex, e)
+		nextSlot()
+	}
+
+	for _, it := range items {
+		itemStamps = it.Stamps
+		data := it.payload()
+		total := len(data)
+		trace("%s -> %s, %d byte(s) on disk\n", it.Path, entryName([]byte(fmt.Sprintf(" %-11s", strings.ToUpper(it.Name83)))), total)
+
+		if dirIndex >= maxDir {
+			fmt.Fprintf(os.Stderr, "Directory full; skipping %s\n", it.Path)
+			continue
+		}
+		if total == 0 {
+			putDir(dirIndex, makeDirEntry(it, 0, 0, nil, g.wideBlocks()))
+			nextSlot()
+			continue
+		}
+
+		var kept []int // source blocks still to place, with KeepLayout
+		if bld.KeepLayout {
+			kept = it.Blocks
+		}
+		var sum [sha256.Size]byte
+		dedup := bld.Dedup && len(kept) == 0 // kept blocks stay where the source had them
+		if dedup {
+			sum = sha256.Sum256(data)
+			if prev, ok := stored[sum]; ok && bytes.Equal(prev.data, data) {
+				if !slotsFit(len(prev.extents)) {
+					fmt.Fprintf(os.Stderr, "Directory full; skipping %s\n", it.Path)
+					continue
+				}
+				for x, blocks := range prev.extents {
+					bytesThis := min(total-x*16*1024, 16*1024)
+					putDir(dirIndex, makeDirEntry(it, x, byte((bytesThis+127)/128), blocks, g.wideBlocks()))
+					nextSlot()
+				}
+				fmt.Fprintf(os.Stderr, "Dedup: %s shares the blocks of %s\n", it.Path, prev.path)
+				continue
+			}
+		}
+		if bld.AlignTrack && len(kept) == 0 {
+			// pad from the lowest free block up to the next free track start, as long
+			// as the whole file still fits from there
+			var skip []int
+			start := -1
+			for b := firstBlock; b < totalBlocks && start < 0; b++ {
+				switch {
+				case used[b]:
+				case aligned(b):
+					start = b
+				default:
+					skip = append(skip, b)
+				}
+			}
+			free := 0
+			for b := start; b >= 0 && b < totalBlocks; b++ {
+				if !used[b] {
+					free++
+				}
+			}
+			if len(skip) > 0 && free < (total+g.BlockSize-1)/g.BlockSize {
+				fmt.Fprintf(os.Stderr, "Align: no track start leaves room for %s; packed instead\n", it.Path)
+				skip = nil
+			}
+			for _, b := range skip {
+				used[b] = true
+			}
+			padBlocks += len(skip)
+			if len(skip) > 0 {
+				trace("  align: blocks %v left empty\n", skip)
+			}
+		}
+		var extents [][]int // blocks of each extent written, for Dedup
+		var pos int
+		extentNo := 0
+		for pos < total {
+			if dirIndex >= maxDir {
+				fmt.Fprintf(os.Stderr, "Directory full; truncating %s\n", it.Path)
+				break
+			}
+			remain := total - pos
+			bytesThis := remain
+			if bytesThis > 16*1024 {
+				bytesThis = 16 * 1024
+			}
+			need := (bytesThis + g.BlockSize - 1) / g.BlockSize
+			var blocks []int
+			var err error
+			how := "alloc"
+			if len(kept) >= need {
+				blocks, kept, how = kept[:need], kept[need:], "kept"
+			} else {
+				blocks, err = alloc(need)
+			}
+			if err == nil && bld.TraceAlloc != nil {
+				trace("  extent %d: %s(%d) -> blocks %v\n", extentNo, how, need, blocks)
+				for _, b := range blocks {
+					chs, _ := g.blockToCHS(b)
+					var at []string
+					for _, c := range chs {
+						at = append(at, fmt.Sprintf("C%d H%d R%d", c.Track, c.Side, c.Sect))
+					}
+					trace("    block %d: %s\n", b, strings.Join(at, ", "))
+				}
+			}
+			if err == errDiskFull {
+				fmt.Fprintf(os.Stderr, "Disk full; truncating %s\n", it.Path)
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			for i, b := range blocks {
+				start := pos + i*g.BlockSize
+				end := start + g.BlockSize
 				if end > total {
 					end = total
 				}
 				if start >= end {
 					break
 				}
-				if err := writeBlock(b, data[start:end]); err != nil {
+				if err := d.writeBlock(b, data[start:end]); err != nil {
 					return nil, err
 				}
+				if bld.Verify {
+					written[b] = data[start:end]
+				}
+			}
+			rc := byte((bytesThis + 127) / 128)
+			putDir(dirIndex, makeDirEntry(it, extentNo, rc, blocks, g.wideBlocks()))
+			nextSlot()
+			pos += bytesThis
+			extentNo++
+			extents = append(extents, blocks)
+		}
+		if dedup && pos == total {
+			if _, ok := stored[sum]; !ok {
+				stored[sum] = storedFile{it.Path, data, extents}
+			}
+		}
+	}
+
+	if padBlocks > 0 {
+		fmt.Fprintf(os.Stderr, "Align: %d block(s) (%dK) left empty to start files on track boundaries (CP/M still counts them as free)\n",
+			padBlocks, padBlocks*g.BlockSize/1024)
+	}
+	if stamped {
+		st := bld.stamp()
+		for sfcb := 3; sfcb < maxDir; sfcb += 4 {
+			e := dir[sfcb*32 : sfcb*32+32]
+			for i := range e {
+				e[i] = 0
+			}
+			e[0] = 0x21
+			for j := 0; j < 3; j++ {
+				slot := sfcb - 3 + j
+				if u := dir[slot*32]; u > 15 { // files only; the label keeps its own
+					continue
+				}
+				if own := fileStamps[slot]; own != nil {
+					copy(e[1+j*10:], own[:])
+					continue
+				}
+				copy(e[1+j*10:], st[:])   // create
+				copy(e[1+j*10+4:], st[:]) // update
+			}
+		}
+	}
+	d.writeDir(dir)
+	if bld.Verify {
+		if err := verifyBlocks(d, written); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Copy rebuilds dst with the files it already holds followed by every file of src,
+// read back with their +3DOS headers, user numbers, attribute bits and datestamps.
+// dst keeps its geometry and Track-Info settings, and its label unless the Builder
+// sets one (src's label is used when neither does); the Builder's Geometry is
+// ignored. Datestamps are turned on when src has them and dst's directory still has
+// room for the stamp entries; files that had none are left with blank stamps. It
+// returns the number of src files copied in full and a line for each one that was
+// skipped, cut short or lost detail on the way.
+func (bld *Builder) Copy(src, dst *Disk) (int, []string, error) {
+	have, err := readFiles(dst, "dst")
+	if err != nil {
+		return 0, nil, err
+	}
+	add, err := readFiles(src, "src")
+	if err != nil {
+		return 0, nil, err
+	}
+	type key struct {
+		user byte
+		name string
+	}
+	var report []string
+	taken := map[key]bool{}
+	for _, it := range have {
+		taken[key{it.User, it.Name83}] = true
+	}
+	items := have
+	var wanted []FileItem
+	srcStamped := false
+	for _, it := range add {
+		if taken[key{it.User, it.Name83}] {
+			report = append(report, fmt.Sprintf("%s: already on the destination; skipped", it.Path))
+			continue
+		}
+		srcStamped = srcStamped || it.Stamps != nil
+		items = append(items, it)
+		wanted = append(wanted, it)
+	}
+
+	b := *bld
+	b.Geometry = dst.Geometry
+	if dirStamped(dst) {
+		b.Stamped = true // files already on dst carry their own; the rest stay blank
+	}
+	if srcStamped && !b.Stamped && b.Stamp.IsZero() {
+		// Every fourth entry becomes a stamp entry and the first holds the label.
+		entries := 1
+		for _, it := range items {
+			entries += max(1, (len(it.payload())+16383)/16384)
+		}
+		if entries <= b.Geometry.DirEntries()/4*3 {
+			b.Stamped = true
+		} else {
+			for i := len(have); i < len(items); i++ {
+				if items[i].Stamps != nil {
+					report = append(report, fmt.Sprintf("%s: datestamps dropped (no directory room for them)", items[i].Path))
+					items[i].Stamps = nil
+				}
 			}
-			rc := byte((bytesThis + 127) / 128)
-			putDir(dirIndex, makeDirEntry(it.Name83, extentNo, rc, blocks))
-			dirIndex++
-			pos += bytesThis
-			extentNo++
 		}
 	}
+	for _, d := range []*Disk{dst, src} { // a label on dst wins over one on src
+		if dir := d.readDir(); b.Label == "" && len(dir) >= 32 && dir[0] == 0x20 {
+			b.Label = strings.TrimSuffix(entryName(dir[:32]), ".")
+		}
+	}
+	d, err := b.Build(items)
+	if err != nil {
+		return 0, nil, err
+	}
+	got, err := readFiles(d, "dst")
+	if err != nil {
+		return 0, nil, err
+	}
+	size := map[key]int64{}
+	for _, it := range got {
+		size[key{it.User, it.Name83}] = it.Size
+	}
+	n := 0
+	for _, it := range wanted {
+		want := int64(len(it.payload()))
+		switch have, ok := size[key{it.User, it.Name83}]; {
+		case !ok:
+			report = append(report, fmt.Sprintf("%s: not copied (directory or disk full)", it.Path))
+		case have < want:
+			report = append(report, fmt.Sprintf("%s: truncated to %d of %d bytes", it.Path, have, want))
+		default:
+			n++
+		}
+	}
+	d.DataRate, d.RecMode, d.Compat = dst.DataRate, dst.RecMode, dst.Compat
+	*dst = *d
+	return n, report, nil
+}
+
+// dirStamped reports whether d's directory holds CP/M 3 datestamp entries.
+func dirStamped(d *Disk) bool {
+	dir := d.readDir()
+	for i := 3 * 32; i < len(dir); i += 4 * 32 {
+		if dir[i] == 0x21 {
+			return true
+		}
+	}
+	return false
+}
 
-	// Write directory (T1, S1..S4)
-	dirOff := 0
-	for s := 1; s <= dirSectors; s++ {
-		copy(d.Sectors[1][s-1][:], dir[dirOff:dirOff+SectorSize])
-		dirOff += SectorSize
+// FreeBlocks returns, in ascending order, the allocation blocks of the data area that
+// are neither directory blocks nor listed by a live (user 0..15) directory entry.
+func (d *Disk) FreeBlocks() []int {
+	g := d.Geometry
+	used := make([]bool, g.DataBlocks())
+	for b := 0; b < g.DirBlocks && b < len(used); b++ {
+		used[b] = true
 	}
-	return d, nil
+	dir := d.readDir()
+	for i := 0; i+32 <= len(dir); i += 32 {
+		if dir[i] > 15 {
+			continue
+		}
+		var e DirEntry
+		copy(e[:], dir[i:i+32])
+		for _, b := range g.blocksOf(e) {
+			if b < len(used) {
+				used[b] = true
+			}
+		}
+	}
+	var free []int
+	for b, u := range used {
+		if !u {
+			free = append(free, b)
+		}
+	}
+	return free
+}
+
+// FreeDirSlots counts the directory entries available for new extents: those whose
+// user byte is 0xE5, whether deleted or never used.
+func (d *Disk) FreeDirSlots() int {
+	dir := d.readDir()
+	n := 0
+	for i := 0; i+32 <= len(dir); i += 32 {
+		if dir[i] == 0xE5 {
+			n++
+		}
+	}
+	return n
+}
+
+// replaceFile swaps the contents of an existing file for it.Data, in place. The old
+// file's extents are removed and its blocks freed; the new contents go to those blocks
+// first, in their old order, and then to the lowest free blocks, so an edited file
+// usually stays where it was. Only the file in user area it.User is replaced, and it
+// keeps its attributes. Nothing is changed when the new contents do not fit.
+func replaceFile(d *Disk, it FileItem) ([]string, error) {
+	g := d.Geometry
+	if g.extentMask() != 0 {
+		return nil, fmt.Errorf("geometry %s: writing files needs %dKB blocks", g.Name, 16/g.entryBlocks())
+	}
+	dir := d.readDir()
+	entry := func(slot int) DirEntry {
+		var e DirEntry
+		copy(e[:], dir[slot*32:slot*32+32])
+		return e
+	}
+
+	var slots []int
+	for slot := 0; slot < g.DirEntries(); slot++ {
+		if e := entry(slot); e[0] == it.User && e.name83() == it.Name83 {
+			slots = append(slots, slot)
+		}
+	}
+	name := entryName(append([]byte{0}, it.Name83...))
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("%s is not in user %d", name, it.User)
+	}
+	sort.SliceStable(slots, func(i, j int) bool { return entry(slots[i]).extent() < entry(slots[j]).extent() })
+	it.Attr = entry(slots[0]).attr()
+
+	// Free the old extents, remembering their blocks for reuse.
+	var freed []int
+	for _, slot := range slots {
+		for _, b := range g.blocksOf(entry(slot)) {
+			if b != 0 && b >= g.DirBlocks && b < g.DataBlocks() {
+				freed = append(freed, b)
+			}
+		}
+		dir[slot*32] = 0xE5
+	}
+	d.writeDir(dir) // not saved unless the replacement succeeds
+
+	// Reuse the old blocks that are now free, in their old order, then the lowest others.
+	isFree := map[int]bool{}
+	var rest []int
+	for _, b := range d.FreeBlocks() {
+		isFree[b] = true
+	}
+	var reuse []int
+	for _, b := range freed {
+		if isFree[b] {
+			delete(isFree, b) // also drops blocks the old file listed twice
+			reuse = append(reuse, b)
+		}
+	}
+	for _, b := range d.FreeBlocks() {
+		if isFree[b] {
+			rest = append(rest, b)
+		}
+	}
+
+	data := it.payload()
+	need := (len(data) + g.BlockSize - 1) / g.BlockSize
+	if avail := len(reuse) + len(rest); need > avail {
+		return nil, fmt.Errorf("%s: %w (needs %d block(s), %d available)", name, errDiskFull, need, avail)
+	}
+	blocks := append(reuse, rest...)[:need]
+
+	// One entry per 16KB extent; a zero-length file still needs one.
+	extents := max(1, (len(data)+16*1024-1)/(16*1024))
+	if n := d.FreeDirSlots(); extents > n {
+		return nil, fmt.Errorf("%s: directory full (needs %d entries, %d free)", name, extents, n)
+	}
+	if err := placeFile(d, dir, it, data, blocks); err != nil {
+		return nil, err
+	}
+
+	return []string{fmt.Sprintf("%s: %d extent(s) on %d block(s) replaced by %d extent(s) on %d block(s), %d reused",
+		name, len(slots), len(freed), extents, len(blocks), min(need, len(reuse)))}, nil
+}
+
+// placeFile writes data to blocks, one 16KB extent at a time, and gives each extent
+// the next free (0xE5) slot of dir, which is then written to the disk. The caller has
+// checked that there are enough blocks and slots.
+func placeFile(d *Disk, dir []byte, it FileItem, data []byte, blocks []int) error {
+	g := d.Geometry
+	var free []int
+	for slot := 0; slot < g.DirEntries(); slot++ {
+		if dir[slot*32] == 0xE5 {
+			free = append(free, slot)
+		}
+	}
+	extents := max(1, (len(data)+16*1024-1)/(16*1024))
+	for x := 0; x < extents; x++ {
+		start := x * 16 * 1024
+		end := min(start+16*1024, len(data))
+		eb := blocks[min(start/g.BlockSize, len(blocks)):min((end+g.BlockSize-1)/g.BlockSize, len(blocks))]
+		for i, b := range eb {
+			chunk := data[start+i*g.BlockSize : min(start+(i+1)*g.BlockSize, end)]
+			if err := d.writeBlock(b, chunk); err != nil {
+				return err
+			}
+		}
+		e := makeDirEntry(it, x, byte((end-start+127)/128), eb, g.wideBlocks())
+		copy(dir[free[x]*32:], e[:])
+	}
+	d.writeDir(dir)
+	return nil
+}
+
+// addFile writes it to free blocks and free directory slots of an existing disk,
+// leaving every other file where it is. A file of the same name in the same user
+// area is refused (see replaceFile), as is one that does not fit; the disk is then
+// unchanged.
+func addFile(d *Disk, it FileItem) ([]string, error) {
+	g := d.Geometry
+	if g.extentMask() != 0 {
+		return nil, fmt.Errorf("geometry %s: writing files needs %dKB blocks", g.Name, 16/g.entryBlocks())
+	}
+	dir := d.readDir()
+	name := entryName(append([]byte{0}, it.Name83...))
+	for slot := 0; slot < g.DirEntries(); slot++ {
+		var e DirEntry
+		copy(e[:], dir[slot*32:slot*32+32])
+		if e[0] == it.User&0x0F && e.name83() == it.Name83 {
+			return nil, fmt.Errorf("%s is already on the disk in user %d (use -replace)", name, e[0])
+		}
+	}
+	data := it.payload()
+	need := (len(data) + g.BlockSize - 1) / g.BlockSize
+	free := d.FreeBlocks()
+	if need > len(free) {
+		return nil, fmt.Errorf("%s: %w (needs %d block(s), %d free)", name, errDiskFull, need, len(free))
+	}
+	extents := max(1, (len(data)+16*1024-1)/(16*1024))
+	if n := d.FreeDirSlots(); extents > n {
+		return nil, fmt.Errorf("%s: directory full (needs %d entries, %d free)", name, extents, n)
+	}
+	blocks := free[:need]
+	if err := placeFile(d, dir, it, data, blocks); err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("%s: %d byte(s) in %d extent(s) on block(s) %v", name, len(data), extents, blocks)}, nil
+}
+
+// deleteFile marks every directory entry of the named file in user area user as
+// deleted (user byte 0xE5), so its blocks count as free again. Files of the same name
+// in other user areas are left alone, and the blocks themselves as they were.
+func deleteFile(d *Disk, user byte, name83 string) ([]string, error) {
+	dir := d.readDir()
+	removed, freed := 0, 0
+	for slot := 0; slot < d.Geometry.DirEntries(); slot++ {
+		var e DirEntry
+		copy(e[:], dir[slot*32:slot*32+32])
+		if e[0] != user || e.name83() != name83 {
+			continue
+		}
+		removed++
+		for _, b := range d.Geometry.blocksOf(e) {
+			if b != 0 {
+				freed++
+			}
+		}
+		dir[slot*32] = 0xE5
+	}
+	name := entryName(append([]byte{0}, name83...))
+	if removed == 0 {
+		return nil, fmt.Errorf("%s is not in user %d", name, user)
+	}
+	d.writeDir(dir)
+	return []string{fmt.Sprintf("%s in user %d: %d extent(s) removed, %d block(s) freed", name, user, removed, freed)}, nil
+}
+
+// renameFile gives every extent of the file from in user area user the name to,
+// keeping the attribute bits CP/M stores in bit 7 of the name bytes. Files of the same
+// names in other user areas are left alone. Nothing is changed unless all of the
+// extents can be renamed.
+func renameFile(d *Disk, user byte, from, to string) ([]string, error) {
+	dir := d.readDir()
+	oldName := entryName(append([]byte{0}, from...))
+	newName := entryName(append([]byte{0}, to...))
+	var slots []int
+	for slot := 0; slot < d.Geometry.DirEntries(); slot++ {
+		var e DirEntry
+		copy(e[:], dir[slot*32:slot*32+32])
+		if e[0] != user {
+			continue
+		}
+		switch e.name83() {
+		case to:
+			return nil, fmt.Errorf("%s is already in user %d", newName, user)
+		case from:
+			slots = append(slots, slot)
+		}
+	}
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("%s is not in user %d", oldName, user)
+	}
+	for _, slot := range slots {
+		for i := 0; i < 11; i++ {
+			b := &dir[slot*32+1+i]
+			*b = *b&0x80 | to[i]
+		}
+	}
+	d.writeDir(dir)
+	return []string{fmt.Sprintf("%s to %s in user %d: %d extent(s)", oldName, newName, user, len(slots))}, nil
+}
+
+// verifyBlocks reads every written block back the way zx3extract's getBlock does,
+// stepping sector by sector from the first data track rather than through
+// blockToCHS, and checks that it starts with the bytes Build put there. Build only
+// makes single-sided disks, so track records follow one another.
+func verifyBlocks(d *Disk, written map[int][]byte) error {
+	g := d.Geometry
+	for b, want := range written {
+		tr, se := g.ReservedTracks, 1
+		for advance := b * g.BlockSectors(); advance > 0; advance-- {
+			if se++; se > g.SectorsPerTrack {
+				se, tr = 1, tr+1
+			}
+		}
+		var got []byte
+		for i := 0; i < g.BlockSectors() && tr < len(d.Sectors); i++ {
+			got = append(got, d.Sectors[tr][se-1][:]...)
+			if se++; se > g.SectorsPerTrack {
+				se, tr = 1, tr+1
+			}
+		}
+		if len(got) < len(want) || !bytes.Equal(got[:len(want)], want) {
+			return fmt.Errorf("verify: block %d does not read back as written", b)
+		}
+	}
+	return nil
 }
 
-func makeDirEntry(name83 string, extent int, rc byte, blocks []int) DirEntry {
+// makeDirEntry builds one extent's directory entry, listing blocks as bytes or, when
+// wide, as 16-bit little-endian words.
+func makeDirEntry(it FileItem, extent int, rc byte, blocks []int, wide bool) DirEntry {
 	var e DirEntry
-	e[0] = 0 // user 0
-	fn := fmt.Sprintf("%-11s", strings.ToUpper(name83))
+	e[0] = it.User & 0x0F
+	fn := fmt.Sprintf("%-11s", strings.ToUpper(it.Name83))
 	copy(e[1:12], []byte(fn[:11]))
+	for i := 0; i < 3; i++ {
+		if it.Attr&(1<<i) != 0 {
+			e[9+i] |= 0x80 // t1' read-only, t2' system, t3' archive
+		}
+	}
 	e[12] = byte(extent & 0x1F)        // EX low 5 bits
-	e[13] = byte((extent >> 5) & 0x07) // S1 high bits of extent (CP/M 2.2)
-	e[14] = 0x00                       // S2 (unused for small files)
+	e[13] = 0x00                       // S1 (reserved)
+	e[14] = byte((extent >> 5) & 0x3F) // S2 extent module (high-order bits of extent)
 	e[15] = rc
-	for i := 0; i < 16 && i < len(blocks); i++ {
-		e[16+i] = byte(blocks[i]) // absolute allocation block numbers (including dir blocks)
+	for i, b := range blocks { // absolute allocation block numbers (including dir blocks)
+		switch {
+		case wide && i < 8:
+			binary.LittleEndian.PutUint16(e[16+2*i:], uint16(b))
+		case !wide && i < 16:
+			e[16+i] = byte(b)
+		}
 	}
 	return e
 }
 
-func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <folder> <out.dsk>\n", os.Args[0])
+// labelEntry builds a CP/M 3 disk label entry: user byte 0x20 and the label as an 8.3
+// name, or blanks if label is empty. The label data byte sets only bit 0 (label exists),
+// so there is no password and no datestamping; the password field is left blank.
+func labelEntry(label string) DirEntry {
+	var e DirEntry
+	e[0] = 0x20
+	copy(e[1:12], "           ")
+	if label != "" {
+		copy(e[1:12], to83(label))
+	}
+	e[12] = 0x01
+	copy(e[16:24], "        ")
+	return e
+}
+
+// cpmStamp encodes t as a CP/M 3 datestamp: the day number (1 = 1 January 1978) in
+// two little-endian bytes, then the hour and minute in BCD. Times are taken as UTC.
+func cpmStamp(t time.Time) [4]byte {
+	t = t.UTC()
+	days := int(t.Sub(time.Date(1977, 12, 31, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	bcd := func(n int) byte { return byte(n/10<<4 | n%10) }
+	return [4]byte{byte(days), byte(days >> 8), bcd(t.Hour()), bcd(t.Minute())}
+}
+
+// parseStamp reads a -timestamp value: seconds since the Unix epoch (as in
+// SOURCE_DATE_EPOCH) or an RFC 3339 time. CP/M 3 stamps start in 1978.
+func parseStamp(s string) (time.Time, error) {
+	var t time.Time
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		t = time.Unix(secs, 0).UTC()
+	} else if t, err = time.Parse(time.RFC3339, s); err != nil {
+		return time.Time{}, fmt.Errorf("timestamp %q is neither Unix seconds nor RFC 3339", s)
+	}
+	if t.Year() < 1978 || t.Year() > 2156 {
+		return time.Time{}, fmt.Errorf("timestamp %s is outside the CP/M 3 range 1978..2156", t.Format(time.RFC3339))
+	}
+	return t, nil
+}
+
+// editInPlace implements the commands that modify the image named by the single
+// argument: it loads the disk, applies fn, prints each reported change after verb
+// and saves the image back only when something changed.
+func editInPlace(cmd, verb string, fn func(*Disk) ([]string, error), unchanged string) {
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s <image.dsk>\n", os.Args[0], cmd)
 		os.Exit(2)
 	}
-	in, out := os.Args[1], os.Args[2]
-	info, err := os.Stat(in)
-	if err != nil || !info.IsDir() {
-		fmt.Fprintf(os.Stderr, "Input must be a folder\n")
+	image := flag.Arg(0)
+	disk, err := loadDisk(image)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
 		os.Exit(1)
 	}
-
-	disk, err := buildDiskFromFolder(in)
+	changes, err := fn(disk)
+	for _, c := range changes {
+		fmt.Printf("%s %s\n", verb, c)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Build error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%s error: %v\n", cmd, err)
 		os.Exit(1)
 	}
+	if len(changes) == 0 {
+		fmt.Println(unchanged)
+		return
+	}
+	saveDisk(image, disk)
+}
 
+// saveDisk serialises disk as an EDSK image and writes it to out.
+func saveDisk(out string, disk *Disk) {
+	saveImage(out, func(w io.Writer) error { return writeEDSK(w, disk) })
+}
+
+// saveImage writes the image produced by write to out, exiting on failure.
+func saveImage(out string, write func(io.Writer) error) {
 	var buf bytes.Buffer
-	if err := writeEDSK(&buf, disk); err != nil {
+	if err := write(&buf); err != nil {
 		fmt.Fprintf(os.Stderr, "Write EDSK error: %v\n", err)
 		os.Exit(1)
 	}
@@ -428,3 +2566,350 @@ func main() {
 	}
 	fmt.Printf("Wrote %s (%d bytes)\n", out, buf.Len())
 }
+
+func main() {
+	flagBlank := flag.Bool("blank", false, "write an empty, formatted +3 disk: -blank <out.dsk>")
+	flagChecksumFix := flag.Bool("checksum-fix", false, "recompute +3DOS header checksums in place: -checksum-fix <image.dsk>")
+	flagRepairDir := flag.Bool("repair-dir", false, "make extent record counts consistent with their blocks in place: -repair-dir <image.dsk>")
+	flagCopy := flag.Bool("copy", false, "write a faithful EDSK copy of an image, keeping every track's sector IDs, sizes, status flags and gaps: -copy <src.dsk> <dst.dsk>")
+	flagRepairSpec := flag.Bool("repair-spec", false, "write the +3 spec for the disk's geometry into T0,S1 in place: -repair-spec <image.dsk>")
+	flagForce := flag.Bool("force", false, "with -repair-spec: replace a spec that already looks valid")
+	flagFrom := flag.String("from", "", "build from a JSON manifest giving every file's name, user, attributes, +3DOS header and data path: -from <manifest.json> <out.dsk>")
+	flagConvert := flag.Bool("convert", false, "re-pack every file of an existing image onto a new disk: -convert <src.dsk> <dst.dsk>")
+	flagCheckNames := flag.Bool("check-names", false, "only report source files whose 8.3 names are mangled: -check-names <folder>")
+	flagStrictNames := flag.Bool("strict-names", false, "fail, listing the offenders, if any 8.3 name differs from its source name other than by case")
+	flagRenameMap := flag.String("rename-map", "", "CSV (source,name) or JSON file giving explicit 8.3 names for source files, by path relative to the folder or by file name")
+	flagMaxDropped := flag.Int("max-dropped", 2, "warn when an 8.3 name drops more than this many characters of its source name")
+	flagFirstBlock := flag.Int("first-block", 0, "first allocation block given to files (default: first block after the directory)")
+	flagKeepLayout := flag.Bool("keep-layout", false, "with -convert: keep every file on the same blocks as in the source image")
+	flagDataRate := flag.String("datarate", "dd", "Track-Info data rate for new images: sd|dd|hd|ed|unknown")
+	flagRecMode := flag.String("recmode", "mfm", "Track-Info recording mode for new images: fm|mfm|unknown")
+	flagVerify := flag.Bool("verify", false, "read every written block back after building and fail if any differs")
+	flagNoHeader := flag.String("noheader", "", "comma-separated globs (e.g. \"*.COM,*.DAT\") of files to write raw, without a +3DOS header")
+	flagFormat := flag.String("format", "180k", "geometry of new images: 180k (+3, 1KB blocks) or 720k (PCW CF2DD, 2KB blocks)")
+	flagUser := flag.Int("user", 0, "CP/M user area (0..15) for the files written, unless a -meta sidecar gives one, and of the file renamed by -rename, removed by -delete or overwritten by -replace")
+	flagSystem := flag.String("system", "", "comma-separated globs (e.g. \"*\" or \"DISK,*.COM\") of files to give the system attribute, hiding them from DIR")
+	flagReadOnly := flag.String("readonly", "", "comma-separated globs of files to give the read-only attribute")
+	flagCompat := flag.String("compat", "zx3dsk", "creator string and Track-Info gap/filler profile for new images: zx3dsk|spectaculator|specide|cpcdiskxp")
+	flagDelete := flag.String("delete", "", "remove NAME.EXT (every extent, in the -user area) from an image in place: [-user N] -delete NAME.EXT <image.dsk>")
+	flagRename := flag.String("rename", "", "rename a file of one user area (see -user) on an image in place: -rename OLD.EXT=NEW.EXT <image.dsk>")
+	flagAdd := flag.Bool("add", false, "write files into free space of an existing image, keeping everything on it: -add <image.dsk> <file>...")
+	flagReplace := flag.String("replace", "", "overwrite the file of the same 8.3 name in the -user area in place, reusing its blocks: -replace <file> <image.dsk>")
+	flagLabel := flag.String("label", "", "write NAME as the disk label (a CP/M 3 label entry in the first directory slot)")
+	flagStamp := flag.String("timestamp", "", "turn on CP/M 3 datestamps, giving every file this create and update time (Unix seconds or RFC 3339), for reproducible images")
+	flagTraceAlloc := flag.Bool("trace-alloc", false, "log each file's block allocations, the sectors every block maps to and the directory entries written (to stderr)")
+	flagAlign := flag.String("align", "block", "where each file starts: block (packed, standard CP/M) or track (first block of a track, padding with empty blocks)")
+	flagDedup := flag.Bool("dedup", false, "store files with identical contents once, their directory entries sharing blocks (non-standard)")
+	flagAlloc := flag.String("alloc", "sequential", "block allocation strategy for new files: sequential|interleaved")
+	flag.Parse()
+
+	// setAttrs applies -system and -readonly to items about to be written.
+	setAttrs := func(items []FileItem) {
+		for _, f := range []struct {
+			name, globs string
+			attr        byte
+		}{{"-system", *flagSystem, attrSystem}, {"-readonly", *flagReadOnly, attrReadOnly}} {
+			if _, err := markAttr(items, f.globs, f.attr); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", f.name, err)
+				os.Exit(2)
+			}
+		}
+	}
+
+	rate, err := parseDataRate(*flagDataRate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	mode, err := parseRecMode(*flagRecMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	compat, ok := compatProfiles[strings.ToLower(*flagCompat)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown compatibility profile %q (want zx3dsk|spectaculator|specide|cpcdiskxp)\n", *flagCompat)
+		os.Exit(2)
+	}
+	strategy, ok := allocStrategies[*flagAlloc]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown allocation strategy %q (want sequential|interleaved)\n", *flagAlloc)
+		os.Exit(2)
+	}
+
+	geom, ok := geometryByName(*flagFormat)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown disk format %q (want 180k|720k)\n", *flagFormat)
+		os.Exit(2)
+	}
+
+	var stamp time.Time
+	if *flagStamp != "" {
+		if stamp, err = parseStamp(*flagStamp); err != nil {
+			fmt.Fprintf(os.Stderr, "-timestamp: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	var traceAlloc io.Writer
+	if *flagTraceAlloc {
+		traceAlloc = os.Stderr
+	}
+	if *flagUser < 0 || *flagUser > 15 {
+		fmt.Fprintf(os.Stderr, "-user %d out of range 0..15\n", *flagUser)
+		os.Exit(2)
+	}
+	if *flagAlign != "block" && *flagAlign != "track" {
+		fmt.Fprintf(os.Stderr, "unknown -align %q (want block|track)\n", *flagAlign)
+		os.Exit(2)
+	}
+	builder := &Builder{FirstBlock: *flagFirstBlock, KeepLayout: *flagKeepLayout, Alloc: strategy, Verify: *flagVerify, Geometry: geom, Dedup: *flagDedup, Label: *flagLabel, Stamp: stamp, TraceAlloc: traceAlloc, AlignTrack: *flagAlign == "track"}
+
+	if *flagChecksumFix {
+		editInPlace("-checksum-fix", "Fixed", fixChecksums, "All +3DOS header checksums are valid; image unchanged.")
+		return
+	}
+	if *flagRepairSpec {
+		editInPlace("-repair-spec", "Fixed", repairSpec(*flagForce), "The spec already matches the disk geometry; image unchanged.")
+		return
+	}
+	if *flagRepairDir {
+		editInPlace("-repair-dir", "Fixed", repairDir, "Directory record counts are consistent; image unchanged.")
+		return
+	}
+
+	if *flagDelete != "" {
+		name := to83(*flagDelete)
+		editInPlace("-delete", "Deleted", func(d *Disk) ([]string, error) { return deleteFile(d, byte(*flagUser), name) }, "")
+		return
+	}
+
+	if *flagRename != "" {
+		from, to, ok := strings.Cut(*flagRename, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Usage: %s -rename OLD.EXT=NEW.EXT <image.dsk>\n", os.Args[0])
+			os.Exit(2)
+		}
+		from, to = to83(from), to83(to)
+		editInPlace("-rename", "Renamed", func(d *Disk) ([]string, error) { return renameFile(d, byte(*flagUser), from, to) }, "")
+		return
+	}
+
+	if *flagAdd {
+		if flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s -add <image.dsk> <file>...\n", os.Args[0])
+			os.Exit(2)
+		}
+		image := flag.Arg(0)
+		disk, err := loadDisk(image)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, path := range flag.Args()[1:] {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "-add: %v\n", err)
+				os.Exit(1)
+			}
+			it := FileItem{Path: path, Size: int64(len(b)), Data: b, Name83: filepath.Base(path), User: byte(*flagUser)}
+			if err := applySidecar(&it); err != nil {
+				fmt.Fprintf(os.Stderr, "-add: %v\n", err)
+				os.Exit(1)
+			}
+			items := []FileItem{it}
+			reportSidecars(items)
+			if _, err := markRaw(items, *flagNoHeader); err != nil {
+				fmt.Fprintf(os.Stderr, "-noheader: %v\n", err)
+				os.Exit(2)
+			}
+			setAttrs(items)
+			items[0].Name83 = to83(items[0].Name83)
+			changes, err := addFile(disk, items[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "-add error: %v; %s not written\n", err, image)
+				os.Exit(1)
+			}
+			for _, c := range changes {
+				fmt.Printf("Added %s\n", c)
+			}
+		}
+		saveDisk(image, disk)
+		return
+	}
+
+	if *flagReplace != "" {
+		b, err := os.ReadFile(*flagReplace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-replace: %v\n", err)
+			os.Exit(1)
+		}
+		items := []FileItem{{Path: *flagReplace, Size: int64(len(b)), Data: b, Name83: filepath.Base(*flagReplace), User: byte(*flagUser)}}
+		if err := applySidecar(&items[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "-replace: %v\n", err)
+			os.Exit(1)
+		}
+		reportSidecars(items)
+		if _, err := markRaw(items, *flagNoHeader); err != nil {
+			fmt.Fprintf(os.Stderr, "-noheader: %v\n", err)
+			os.Exit(2)
+		}
+		setAttrs(items)
+		items[0].Name83 = to83(items[0].Name83)
+		editInPlace("-replace", "Replaced", func(d *Disk) ([]string, error) { return replaceFile(d, items[0]) }, "")
+		return
+	}
+
+	if *flagDedup && !*flagBlank {
+		fmt.Fprintf(os.Stderr, "Warning: -dedup lets several files share blocks, which CP/M and +3DOS do not expect; erasing or rewriting one of them on a +3 or in other tools corrupts the rest\n")
+	}
+
+	if *flagCopy {
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s -copy <src.dsk> <dst.dsk>\n", os.Args[0])
+			os.Exit(2)
+		}
+		src, err := parseDSK(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Copying %d track(s) on %d side(s)\n", len(src.Tracks), src.sides)
+		flagged := 0
+		src.EachSector(func(_, _, _ int, _ []byte, st1, st2 byte) {
+			if st1|st2 != 0 {
+				flagged++
+			}
+		})
+		if flagged > 0 {
+			fmt.Printf("Keeping the FDC error flags of %d sector(s)\n", flagged)
+		}
+		saveImage(flag.Arg(1), func(w io.Writer) error { return writeTracks(w, compat.Creator, src.sides, src.trackLayouts()) })
+		return
+	}
+
+	if *flagFrom != "" {
+		if flag.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s -from <manifest.json> <out.dsk>\n", os.Args[0])
+			os.Exit(2)
+		}
+		items, err := loadManifest(*flagFrom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-from: %v\n", err)
+			os.Exit(1)
+		}
+		disk, err := builder.Build(items)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Build error: %v\n", err)
+			os.Exit(1)
+		}
+		disk.DataRate, disk.RecMode, disk.Compat = rate, mode, compat
+		fmt.Printf("Built %d file(s) from %s\n", len(items), *flagFrom)
+		saveDisk(flag.Arg(0), disk)
+		return
+	}
+
+	if *flagConvert {
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s -convert <src.dsk> <dst.dsk>\n", os.Args[0])
+			os.Exit(2)
+		}
+		src, err := loadDisk(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+			os.Exit(1)
+		}
+		disk := newBlankDisk(geom)
+		disk.DataRate, disk.RecMode, disk.Compat = rate, mode, compat
+		n, report, err := builder.Copy(src, disk)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Copy error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, r := range report {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", r)
+		}
+		fmt.Printf("Copied %d file(s)\n", n)
+		saveDisk(flag.Arg(1), disk)
+		return
+	}
+
+	if *flagBlank {
+		if flag.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s -blank [-format 180k|720k] <out.dsk>\n", os.Args[0])
+			os.Exit(2)
+		}
+		disk := newBlankDisk(geom)
+		disk.DataRate, disk.RecMode, disk.Compat = rate, mode, compat
+		saveDisk(flag.Arg(0), disk)
+		return
+	}
+
+	if flag.NArg() != 2 && !(*flagCheckNames && flag.NArg() == 1) {
+		fmt.Fprintf(os.Stderr, "Usage: %s <folder> <out.dsk>\n       %s -blank [-format 180k|720k] <out.dsk>\n       %s -checksum-fix <image.dsk>\n       %s -convert <src.dsk> <dst.dsk>\n       %s -copy <src.dsk> <dst.dsk>\n       %s -from <manifest.json> <out.dsk>\n       %s -check-names <folder>\n       %s -repair-dir <image.dsk>\n       %s -repair-spec [-force] <image.dsk>\n       %s -replace <file> <image.dsk>\n       %s -add <image.dsk> <file>...\n       %s [-user N] -delete NAME.EXT <image.dsk>\n       %s -rename OLD.EXT=NEW.EXT <image.dsk>\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		os.Exit(2)
+	}
+	in := flag.Arg(0)
+	info, err := os.Stat(in)
+	if err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "Input must be a folder\n")
+		os.Exit(1)
+	}
+
+	var renames map[string]string
+	if *flagRenameMap != "" {
+		if renames, err = loadRenameMap(*flagRenameMap); err != nil {
+			fmt.Fprintf(os.Stderr, "-rename-map: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	items, notes, err := collectFolder(in, renames, byte(*flagUser))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Build error: %v\n", err)
+		os.Exit(1)
+	}
+	reportSidecars(items)
+	for _, msg := range notes {
+		fmt.Fprintf(os.Stderr, "Name warning: %s\n", msg)
+	}
+	issues := checkNames(items, *flagMaxDropped)
+	for _, msg := range issues {
+		fmt.Fprintf(os.Stderr, "Name warning: %s\n", msg)
+	}
+	if *flagStrictNames {
+		if bad := strictNames(items); len(bad) > 0 {
+			for _, msg := range bad {
+				fmt.Fprintf(os.Stderr, "Name changed: %s\n", msg)
+			}
+			fmt.Fprintf(os.Stderr, "-strict-names: %d file name(s) would not survive unchanged; nothing written\n", len(bad))
+			os.Exit(1)
+		}
+	}
+	if *flagCheckNames {
+		if len(issues) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("All names map cleanly to 8.3.")
+		return
+	}
+
+	if *flagNoHeader != "" {
+		n, err := markRaw(items, *flagNoHeader)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-noheader: %v\n", err)
+			os.Exit(2)
+		}
+		fmt.Printf("Writing %d file(s) without a +3DOS header\n", n)
+	}
+	setAttrs(items)
+
+	out := flag.Arg(1)
+	disk, err := builder.Build(items)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Build error: %v\n", err)
+		os.Exit(1)
+	}
+	disk.DataRate, disk.RecMode, disk.Compat = rate, mode, compat
+	saveDisk(out, disk)
+}
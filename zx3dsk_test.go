@@ -0,0 +1,624 @@
+package main
+
+// Each tool is its own main package, so the tests are run one tool at a time:
+//
+//	go test zx3dsk.go zx3dsk_test.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildTool compiles another of the repo's tools, e.g. "zx3extract", into a
+// temporary directory and returns the path of the binary.
+func buildTool(t *testing.T, name string) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), name)
+	if out, err := exec.Command("go", "build", "-o", bin, name+".go").CombinedOutput(); err != nil {
+		t.Fatalf("go build %s.go: %v\n%s", name, err, out)
+	}
+	return bin
+}
+
+// saveTestDisk writes d to a temporary image and returns its path.
+func saveTestDisk(t *testing.T, d *Disk) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeEDSK(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.dsk")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeFiles creates the named files in dir.
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtractBuildRoundTrip(t *testing.T) {
+	items := []FileItem{
+		{Path: "loader.bas", Name83: to83("LOADER.BAS"), Data: bytes.Repeat([]byte{0x0D}, 300)},
+		{Path: "screen.scr", Name83: to83("SCREEN.SCR"), Data: make([]byte, 6912), User: 5, Attr: attrSystem},
+		{Path: "readme", Name83: to83("README"), Data: []byte("plain text, no header"), User: 3, Raw: true,
+			Attr: attrReadOnly | attrArchive},
+		{Path: "big.bin", Name83: to83("BIG.BIN"), Data: bytes.Repeat([]byte("0123456789"), 4000), User: 3},
+	}
+	for i := range items {
+		items[i].Size = int64(len(items[i].Data))
+	}
+	orig, err := (&Builder{}).Build(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := saveTestDisk(t, orig)
+
+	out := t.TempDir()
+	if b, err := exec.Command(buildTool(t, "zx3extract"), "-meta", image, out).CombinedOutput(); err != nil {
+		t.Fatalf("zx3extract: %v\n%s", err, b)
+	}
+	rebuilt, _, err := collectFolder(out, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range rebuilt {
+		if len(it.Sidecars) != 1 {
+			t.Errorf("%s: sidecars %v, want its .json", it.Path, it.Sidecars)
+		}
+	}
+	copyDisk, err := (&Builder{}).Build(rebuilt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := readFiles(orig, "orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFiles(copyDisk, "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("copy holds %d file(s), want %d", len(got), len(want))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.Name83 != w.Name83 || g.User != w.User || g.Attr != w.Attr {
+			t.Errorf("catalog entry %d: got user %d %q attr %d, want user %d %q attr %d",
+				i, g.User, g.Name83, g.Attr, w.User, w.Name83, w.Attr)
+		}
+		if !bytes.Equal(g.Data, w.Data) {
+			t.Errorf("%s: contents differ after the round trip", w.Name83)
+		}
+	}
+}
+
+func TestUnrelatedSidecarNamesAreStored(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"config":      []byte("key=value\n"),
+		"config.json": []byte(`{"user": 3, "name": "OTHER"}`),
+		"notes":       []byte("notes\n"),
+		"notes.hdr":   bytes.Repeat([]byte{'x'}, 128),
+		"game":        []byte("body"),
+		"game.p3h":    plus3Header([]byte("body"), 3, 32768, 0),
+	})
+	items, _, err := collectFolder(dir, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]FileItem{}
+	for _, it := range items {
+		byName[filepath.Base(it.Path)] = it
+	}
+	for _, name := range []string{"config", "config.json", "notes", "notes.hdr", "game"} {
+		if _, ok := byName[name]; !ok {
+			t.Errorf("%s was not collected", name)
+		}
+	}
+	if _, ok := byName["game.p3h"]; ok {
+		t.Errorf("game.p3h, a copy of game's header, was collected as a file")
+	}
+	if it := byName["config"]; it.User != 0 || len(it.Sidecars) != 0 {
+		t.Errorf("config took user %d and sidecars %v from an unrelated config.json", it.User, it.Sidecars)
+	}
+	if sc := byName["game"].Sidecars; len(sc) != 1 || filepath.Base(sc[0]) != "game.p3h" {
+		t.Errorf("game sidecars %v, want game.p3h", sc)
+	}
+}
+
+func TestInPlaceEditKeepsSectorIDs(t *testing.T) {
+	items := []FileItem{{Path: "a.bin", Name83: to83("A.BIN"), Data: []byte("contents"), Size: 8}}
+	built, err := (&Builder{}).Build(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renumber every track from 0x41, as PCW formats do, and flag one sector.
+	tracks := built.trackLayouts()
+	for tr := range tracks {
+		tracks[tr].Gap3 = 0x2A
+		for s := range tracks[tr].Sectors {
+			tracks[tr].Sectors[s].R += 0x40
+		}
+	}
+	tracks[5].Sectors[3].ST1, tracks[5].Sectors[3].ST2 = 0x20, 0x20
+	var buf bytes.Buffer
+	if err := writeTracks(&buf, "test", 1, tracks); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(t.TempDir(), "pcw.dsk")
+	if err := os.WriteFile(image, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := loadDisk(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renameFile(d, 0, to83("A.BIN"), to83("B.BIN")); err != nil {
+		t.Fatal(err)
+	}
+	saved := saveTestDisk(t, d)
+
+	pd, err := parseDSK(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tr, want := range tracks {
+		got := pd.Tracks[tr]
+		if got.Gap3 != want.Gap3 || len(got.Sectors) != len(want.Sectors) {
+			t.Fatalf("track %d: gap %#x and %d sector(s), want %#x and %d", tr, got.Gap3, len(got.Sectors), want.Gap3, len(want.Sectors))
+		}
+		for s, sec := range got.Sectors {
+			w := want.Sectors[s]
+			if byte(sec.R) != w.R || sec.ST1 != w.ST1 || sec.ST2 != w.ST2 {
+				t.Errorf("track %d sector %d: R %#x ST1 %#x ST2 %#x, want R %#x ST1 %#x ST2 %#x",
+					tr, s, sec.R, sec.ST1, sec.ST2, w.R, w.ST1, w.ST2)
+			}
+		}
+	}
+	reloaded, err := loadDisk(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := readFiles(reloaded, "saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name83 != to83("B.BIN") || string(files[0].Data[128:136]) != "contents" {
+		t.Errorf("after the rename the disk holds %+v", files)
+	}
+}
+
+func TestFixChecksumsWideBlocks(t *testing.T) {
+	// Past block 255 the low byte of the first block number names another block.
+	items := []FileItem{{Path: "game.bin", Name83: to83("GAME.BIN"), Data: make([]byte, 5000), Size: 5000}}
+	d, err := (&Builder{Geometry: PCW720Geometry, FirstBlock: 300}).Build(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := d.readBlock(300)
+	b[127] ^= 0xFF
+	_ = d.writeBlock(300, b)
+	fixed, err := fixChecksums(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed) != 1 {
+		t.Fatalf("fixChecksums fixed %v, want GAME.BIN", fixed)
+	}
+	if b, _ := d.readBlock(300); b[127] != plus3Checksum(b) {
+		t.Errorf("checksum still wrong after the fix")
+	}
+}
+
+// dirSectorsOf lists, as track record and sector ID pairs, the directory sectors of
+// each known geometry. The reader tests find the directory in images zx3dsk writes
+// and check that they look for it in the same sectors.
+var dirSectorsOf = map[string][][2]int{
+	"180k": {{1, 1}, {1, 2}, {1, 3}, {1, 4}},
+	"720k": {{1, 1}, {1, 2}, {1, 3}, {1, 4}, {1, 5}, {1, 6}, {1, 7}, {1, 8}, {1, 9},
+		{2, 1}, {2, 2}, {2, 3}, {2, 4}, {2, 5}, {2, 6}, {2, 7}},
+}
+
+func TestDirectoryLocations(t *testing.T) {
+	for _, g := range KnownGeometries {
+		var got [][2]int
+		for b := 0; b < g.DirBlocks; b++ {
+			chs, err := g.blockToCHS(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range chs {
+				got = append(got, [2]int{int(c.Track)*g.Sides + int(c.Side), int(c.Sect)})
+			}
+		}
+		if want := dirSectorsOf[g.Name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: directory sectors %v, want %v", g.Name, got, want)
+		}
+		if len(got)*g.SectorSize != g.DirSize() {
+			t.Errorf("%s: %d directory sector(s) for a %d-byte directory", g.Name, len(got), g.DirSize())
+		}
+
+		// A full directory must read back whole.
+		items := make([]FileItem, g.DirEntries())
+		for i := range items {
+			name := fmt.Sprintf("F%03d.BIN", i)
+			items[i] = FileItem{Path: name, Name83: to83(name), Data: []byte{byte(i)}, Size: 1, Raw: true}
+		}
+		d, err := (&Builder{Geometry: g}).Build(items)
+		if err != nil {
+			t.Fatalf("%s: %v", g.Name, err)
+		}
+		files, err := readFiles(d, g.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(items) {
+			t.Errorf("%s: %d file(s) read back from a full directory, want %d", g.Name, len(files), len(items))
+		}
+	}
+}
+
+func TestCopyKeepsDatestamps(t *testing.T) {
+	when := time.Date(1987, 6, 5, 4, 3, 0, 0, time.UTC)
+	src, err := (&Builder{Stamp: when}).Build([]FileItem{{Path: "new.bin", Name83: to83("NEW.BIN"), Data: []byte("new"), Size: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyOnce := func() *Disk {
+		dst, err := (&Builder{}).Build([]FileItem{{Path: "old.bin", Name83: to83("OLD.BIN"), Data: []byte("old"), Size: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, report, err := (&Builder{}).Copy(src, dst)
+		if err != nil || n != 1 || len(report) != 0 {
+			t.Fatalf("Copy: %d file(s), report %q, error %v", n, report, err)
+		}
+		return dst
+	}
+	dst := copyOnce()
+	if !dirStamped(dst) {
+		t.Fatal("destination has room for datestamps but they were not turned on")
+	}
+	files, err := readFiles(dst, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := cpmStamp(when)
+	want := map[string][8]byte{
+		to83("OLD.BIN"): {}, // blank, not the time of the copy
+		to83("NEW.BIN"): {st[0], st[1], st[2], st[3], st[0], st[1], st[2], st[3]},
+	}
+	for _, f := range files {
+		var got [8]byte
+		if f.Stamps != nil {
+			got = *f.Stamps
+		}
+		if got != want[f.Name83] {
+			t.Errorf("%s: stamps %v, want %v", f.Name83, got, want[f.Name83])
+		}
+	}
+	if !bytes.Equal(saveBytes(t, dst), saveBytes(t, copyOnce())) {
+		t.Error("copying the same disks twice gave different images")
+	}
+}
+
+// saveBytes returns d serialised as an EDSK image.
+func saveBytes(t *testing.T, d *Disk) []byte {
+	t.Helper()
+	b, err := os.ReadFile(saveTestDisk(t, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEachSectorKeepsIDsAndFlags(t *testing.T) {
+	tracks := newFormattedDisk().trackLayouts()
+	tracks[2].Sectors[0], tracks[2].Sectors[1] = tracks[2].Sectors[1], tracks[2].Sectors[0]
+	tracks[2].Sectors[0].ST1, tracks[2].Sectors[0].ST2 = 0x20, 0x20
+	var buf bytes.Buffer
+	if err := writeTracks(&buf, "test", 1, tracks); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(t.TempDir(), "flags.dsk")
+	if err := os.WriteFile(image, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pd, err := parseDSK(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []SectorLayout
+	pd.EachSector(func(cyl, head, r int, data []byte, st1, st2 byte) {
+		got = append(got, SectorLayout{C: byte(cyl), H: byte(head), R: byte(r), ST1: st1, ST2: st2})
+	})
+	var want []SectorLayout
+	for _, tr := range tracks {
+		for _, sec := range tr.Sectors {
+			want = append(want, SectorLayout{C: sec.C, H: sec.H, R: sec.R, ST1: sec.ST1, ST2: sec.ST2})
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EachSector walked %v, want %v", got, want)
+	}
+}
+
+func TestRenameStaysInUserArea(t *testing.T) {
+	d, err := (&Builder{}).Build([]FileItem{
+		{Path: "a0", Name83: to83("A.BIN"), Data: []byte("a0"), Size: 2},
+		{Path: "a3", Name83: to83("A.BIN"), Data: []byte("a3"), Size: 2, User: 3},
+		{Path: "b3", Name83: to83("B.BIN"), Data: []byte("b3"), Size: 2, User: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renameFile(d, 3, to83("A.BIN"), to83("B.BIN")); err == nil {
+		t.Error("renaming over B.BIN in user 3 succeeded")
+	}
+	if _, err := renameFile(d, 0, to83("A.BIN"), to83("B.BIN")); err != nil {
+		t.Fatalf("B.BIN in user 3 blocked a rename in user 0: %v", err)
+	}
+	files, err := readFiles(d, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range files {
+		got[fmt.Sprintf("%d:%s", f.User, f.Name83)] = string(f.Data[128:130])
+	}
+	want := map[string]string{"0:" + to83("B.BIN"): "a0", "3:" + to83("A.BIN"): "a3", "3:" + to83("B.BIN"): "b3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after the rename the disk holds %q, want %q", got, want)
+	}
+}
+
+func TestDeleteStaysInUserArea(t *testing.T) {
+	d, err := (&Builder{}).Build([]FileItem{
+		{Path: "a0", Name83: to83("A.BIN"), Data: []byte("a0"), Size: 2},
+		{Path: "a3", Name83: to83("A.BIN"), Data: []byte("a3"), Size: 2, User: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deleteFile(d, 5, to83("A.BIN")); err == nil {
+		t.Error("deleting A.BIN from user 5, which holds no files, succeeded")
+	}
+	if _, err := deleteFile(d, 3, to83("A.BIN")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := readFiles(d, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].User != 0 || string(files[0].Data[128:130]) != "a0" {
+		t.Errorf("after deleting A.BIN from user 3 the disk holds %+v, want A.BIN in user 0 only", files)
+	}
+}
+
+func TestReplaceInUserArea(t *testing.T) {
+	d, err := (&Builder{}).Build([]FileItem{
+		{Path: "a0", Name83: to83("A.BIN"), Data: []byte("a0"), Size: 2},
+		{Path: "a3", Name83: to83("A.BIN"), Data: []byte("a3"), Size: 2, User: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := FileItem{Path: "new", Name83: to83("A.BIN"), Data: []byte("n3"), Size: 2, User: 3}
+	if _, err := replaceFile(d, it); err != nil {
+		t.Fatal(err)
+	}
+	files, err := readFiles(d, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[byte]string{}
+	for _, f := range files {
+		got[f.User] = string(f.Data[128:130])
+	}
+	if want := map[byte]string{0: "a0", 3: "n3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after replacing A.BIN in user 3 the disk holds %q, want %q", got, want)
+	}
+}
+
+func TestAllocStrategiesExtract(t *testing.T) {
+	extract := buildTool(t, "zx3extract")
+	data := map[string][]byte{
+		"A.BIN": bytes.Repeat([]byte("a"), 5000),
+		"B.BIN": []byte("b"),
+		"C.BIN": bytes.Repeat([]byte("c"), 20000), // two extents
+	}
+	for name, alloc := range allocStrategies {
+		var items []FileItem
+		for _, n := range []string{"A.BIN", "B.BIN", "C.BIN"} {
+			items = append(items, FileItem{Path: n, Name83: to83(n), Data: data[n], Size: int64(len(data[n]))})
+		}
+		d, err := (&Builder{Alloc: alloc}).Build(items)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		files, err := readFiles(d, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adjacent := 0
+		for _, f := range files {
+			for i := 1; i < len(f.Blocks); i++ {
+				if f.Blocks[i] == f.Blocks[i-1]+1 {
+					adjacent++
+				}
+			}
+		}
+		if name == "interleaved" && adjacent > 0 {
+			t.Errorf("interleaved: %d pair(s) of consecutive blocks", adjacent)
+		}
+
+		out := t.TempDir()
+		if b, err := exec.Command(extract, saveTestDisk(t, d), out).CombinedOutput(); err != nil {
+			t.Fatalf("%s: zx3extract: %v\n%s", name, err, b)
+		}
+		for n, want := range data {
+			if got, err := os.ReadFile(filepath.Join(out, n)); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s: %s extracted as %d byte(s) (%v), want the %d written", name, n, len(got), err, len(want))
+			}
+		}
+	}
+}
+
+func TestZeroLengthFileRoundTrip(t *testing.T) {
+	d, err := (&Builder{}).Build([]FileItem{{Path: "empty", Name83: to83("EMPTY"), Raw: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if b, err := exec.Command(buildTool(t, "zx3extract"), "-meta", saveTestDisk(t, d), out).CombinedOutput(); err != nil {
+		t.Fatalf("zx3extract: %v\n%s", err, b)
+	}
+	if fi, err := os.Stat(filepath.Join(out, "EMPTY.")); err != nil || fi.Size() != 0 {
+		t.Fatalf("EMPTY. extracted as %v (%v), want 0 bytes", fi, err)
+	}
+	b, err := os.ReadFile(filepath.Join(out, "EMPTY..json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta struct {
+		TotalBytes int `json:"total_bytes_from_rc"`
+		OutputSize int `json:"output_size"`
+		Extents    []map[string]any
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"extent": 0.0, "rc": 0.0, "blocks": []any{}, "rc_exceeds_blocks": false}
+	if meta.TotalBytes != 0 || meta.OutputSize != 0 || len(meta.Extents) != 1 || !reflect.DeepEqual(meta.Extents[0], want) {
+		t.Errorf("metadata %s, want 0 bytes in one RC 0 extent with no blocks and no problems", b)
+	}
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	items := []FileItem{{Path: "a.bin", Name83: to83("A.BIN"), Data: bytes.Repeat([]byte{7}, 3000), Size: 3000}}
+	d, err := (&Builder{Verify: true}).Build(items)
+	if err != nil {
+		t.Fatalf("Build with Verify: %v", err)
+	}
+	files, err := readFiles(d, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := map[int][]byte{}
+	for _, b := range files[0].Blocks {
+		written[b], _ = d.readBlock(b)
+	}
+	if err := verifyBlocks(d, written); err != nil {
+		t.Fatalf("verifyBlocks on an untouched disk: %v", err)
+	}
+	last := files[0].Blocks[len(files[0].Blocks)-1]
+	chs, _ := d.Geometry.blockToCHS(last)
+	d.sector(chs[1])[100] ^= 0xFF
+	if err := verifyBlocks(d, written); err == nil {
+		t.Error("verifyBlocks missed a changed byte in the second sector of a block")
+	}
+}
+
+func TestGeometryCapacity(t *testing.T) {
+	want := map[string]struct{ blocks, capacity, entries int }{
+		"180k": {175, 175*1024 - 2*1024, 64},  // 39 tracks of 9 x 512 bytes in 1KB blocks
+		"720k": {357, 357*2048 - 4*2048, 256}, // 159 tracks of 9 x 512 bytes in 2KB blocks
+	}
+	for _, g := range KnownGeometries {
+		w, ok := want[g.Name]
+		if !ok {
+			t.Errorf("%s: no expected capacity", g.Name)
+			continue
+		}
+		if g.DataBlocks() != w.blocks || g.Capacity() != w.capacity || g.DirEntries() != w.entries {
+			t.Errorf("%s: %d blocks, %d bytes free, %d entries; want %d, %d and %d",
+				g.Name, g.DataBlocks(), g.Capacity(), g.DirEntries(), w.blocks, w.capacity, w.entries)
+		}
+		if _, err := (&Builder{Geometry: g}).Build([]FileItem{{Path: "fill", Name83: to83("FILL"), Data: make([]byte, g.Capacity()), Raw: true}}); err != nil {
+			t.Errorf("%s: a file of the whole capacity does not fit: %v", g.Name, err)
+		}
+	}
+}
+
+func TestAliasNamesStayDistinct(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{}
+	for i := 1; i <= 20; i++ {
+		files[fmt.Sprintf("longprefix%02d.txt", i)] = []byte{byte(i)}
+	}
+	writeFiles(t, dir, files)
+	items, _, err := collectFolder(dir, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]string{}
+	aliases := 0
+	for _, it := range items {
+		if prev, dup := seen[it.Name83]; dup {
+			t.Errorf("%s and %s share the name %q", prev, it.Path, it.Name83)
+		}
+		seen[it.Name83] = it.Path
+		if strings.Contains(it.Name83, "~") {
+			aliases++
+		}
+	}
+	// The first file keeps the plain truncated name; every later one needs an alias.
+	if len(seen) != 20 || aliases != 19 {
+		t.Errorf("%d distinct name(s) and %d alias(es) for 20 files, want 20 and 19: %v", len(seen), aliases, seen)
+	}
+}
+
+func TestRenamedSectorIsMissing(t *testing.T) {
+	built, err := (&Builder{}).Build([]FileItem{{Path: "a.bin", Name83: to83("A.BIN"), Data: []byte("a"), Size: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Number track 5 from 0x41 and rename R1 on track 3: the first keeps an ID base of
+	// its own, the second must not shift its other sectors down to fill the gap.
+	tracks := built.trackLayouts()
+	for s := range tracks[5].Sectors {
+		tracks[5].Sectors[s].R += 0x40
+	}
+	load := func() error {
+		var buf bytes.Buffer
+		if err := writeTracks(&buf, "test", 1, tracks); err != nil {
+			t.Fatal(err)
+		}
+		image := filepath.Join(t.TempDir(), "test.dsk")
+		if err := os.WriteFile(image, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadDisk(image)
+		return err
+	}
+	if err := load(); err != nil {
+		t.Fatalf("with track 5 numbered from 0x41: %v", err)
+	}
+	for s := range tracks[3].Sectors {
+		if tracks[3].Sectors[s].R == 1 {
+			tracks[3].Sectors[s].R = 0x20
+		}
+	}
+	if err := load(); err == nil || err.Error() != "missing sector T3 R1" {
+		t.Errorf("with T3 R1 renamed, loadDisk returned %v, want missing sector T3 R1", err)
+	}
+}
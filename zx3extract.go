@@ -5,7 +5,7 @@ package main
 // Metadata includes CP/M directory info and +3DOS header fields (when present).
 //
 // Build: go build -o zx3extract zx3extract.go
-// Usage: ./zx3extract <image.dsk> <outdir> [-keepheader] [-meta]
+// Usage: ./zx3extract <image.dsk> <outdir> [-keepheader] [-meta] [-hdr]
 
 import (
 	"bytes"
@@ -14,11 +14,16 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type diskType int
@@ -29,23 +34,80 @@ const (
 )
 
 type secHeader struct{ C,H,R,N,ST1,ST2 byte; DataLen uint16 }
-type sector struct{ R int; Data []byte }
+type sector struct{ R int; N, ST1, ST2 byte; Data []byte }
 type track struct{ Sectors []sector; ByID map[int]*sector }
 type disk struct {
 	kind   diskType
 	tracks int
 	sides  int
 	trackSize []int
-	Tracks []track // cylinder index -> track
+	Tracks []track // track record index (cylinder*sides + side) -> track
+	dirAL  uint16  // AL0/AL1 directory bitmap, set by dirSectors
+	forced *layout // -geometry override; replaces every layout detection when set
+	idBase, idSpan int // sector ID the tracks number from and how many a full track runs to; see settleIDs
 }
 
 func readExactly(r io.Reader, n int) ([]byte, error) { buf := make([]byte, n); _, err := io.ReadFull(r, buf); return buf, err }
 
-func parseDSK(path string) (*disk, error) {
+// dskMagics are the Disk-Info signatures of standard and extended DSK images.
+var dskMagics = [][]byte{ []byte("EXTENDED CPC DSK File\r\nDisk-Info\r\n"), []byte("MV - CPCEMU Disk-File\r\nDisk-Info\r\n") }
+
+// skipJunk positions f at the DSK header, searching the first 4KB for a signature: stray
+// bytes (download artifacts) sometimes precede it. Skipped bytes are reported as a warning to warn.
+func skipJunk(f *os.File, path string, warn io.Writer) error {
+	buf := make([]byte, 4096)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF { return err }
+	off := -1
+	for _, m := range dskMagics {
+		if i := bytes.Index(buf[:n], m); i >= 0 && (off < 0 || i < off) { off = i }
+	}
+	if off > 0 {
+		fmt.Fprintf(warn, "Warning: %s: skipping %d junk byte(s) before the DSK header\n", path, off)
+	} else { off = 0 }
+	_, err = f.Seek(int64(off), io.SeekStart)
+	return err
+}
+
+// nextTrack skips to the next Track-Info, resynchronising on its magic (with a warning
+// to warn) when the Disk-Info track size does not match the sectors actually read.
+func nextTrack(f *os.File, path string, t, size, read int, warn io.Writer) error {
+	end, err := f.Seek(0, io.SeekCurrent); if err != nil { return err }
+	magic := []byte("Track-Info\r\n")
+	if pad := size - read; pad >= 0 {
+		probe := make([]byte, len(magic))
+		if n, _ := f.ReadAt(probe, end+int64(pad)); n < len(magic) || bytes.Equal(probe, magic) {
+			_, err = f.Seek(end+int64(pad), io.SeekStart) // as the table says, or the last track
+			return err
+		}
+	}
+	buf := make([]byte, 0x10000)
+	n, _ := f.ReadAt(buf, end)
+	i := bytes.Index(buf[:n], magic)
+	if i < 0 {
+		if read > size { fmt.Fprintf(warn, "Warning: %s: track %d holds %d bytes, more than the %d in the Disk-Info table\n", path, t, read, size) }
+		_, err = f.Seek(end, io.SeekStart) // trust the bytes actually read
+		return err
+	}
+	fmt.Fprintf(warn, "Warning: %s: track %d is %d bytes in the Disk-Info table but the next Track-Info starts after %d; resynchronised there\n",
+		path, t, size, read+i)
+	_, err = f.Seek(end+int64(i), io.SeekStart)
+	return err
+}
+
+// parseDSK reads a DSK image, writing warnings about its framing to warn.
+func parseDSK(path string, warn io.Writer) (*disk, error) {
 	f, err := os.Open(path); if err != nil { return nil, err }
 	defer f.Close()
+	if err := skipJunk(f, path, warn); err != nil { return nil, err }
 
-	hdr, err := readExactly(f, 256); if err != nil { return nil, err }
+	// The Disk-Info block is 256 bytes, but only 0x00..0x33 (plus the extended size
+	// table) carry data. Accept a file that ends inside the block as a minimal image
+	// with no track data instead of rejecting it outright.
+	hdr := make([]byte, 256)
+	hdrLen, err := io.ReadFull(f, hdr)
+	short := errors.Is(err, io.ErrUnexpectedEOF) && hdrLen >= 0x34
+	if err != nil && !short { return nil, err }
 
 	var kind diskType
 	switch {
@@ -65,14 +127,15 @@ func parseDSK(path string) (*disk, error) {
 	total := tracks * sides
 	ts := make([]int, total)
 	if kind == dskExtended {
-		if 0x34+total > 256 { return nil, errors.New("invalid track size table") }
+		if 0x34+total > 256 || (short && 0x34+total > hdrLen) { return nil, errors.New("invalid track size table") }
 		for i := 0; i < total; i++ { ts[i] = int(hdr[0x34+i]) * 256 }
 	} else {
 		sizeLE := binary.LittleEndian.Uint16(hdr[0x32:0x34]); if sizeLE == 0 { sizeLE = 0x1300 }
 		for i := 0; i < total; i++ { ts[i] = int(sizeLE) }
 	}
 
-	d := &disk{ kind: kind, tracks: tracks, sides: sides, trackSize: ts, Tracks: make([]track, tracks) }
+	d := &disk{ kind: kind, tracks: tracks, sides: sides, trackSize: ts, Tracks: make([]track, total) }
+	if short { settleIDs(d); return d, nil } // header-only image: every track unformatted
 
 	// Read tracks one by one using sizes
 	for t := 0; t < total; t++ {
@@ -101,62 +164,461 @@ func parseDSK(path string) (*disk, error) {
 			if want < 0 { return nil, fmt.Errorf("track %d sector %d: bad length", t, i+1) }
 			payload, err := readExactly(f, want); if err != nil { return nil, fmt.Errorf("track %d: %w", t, err) }
 			read += want
-			trk.Sectors[i] = sector{ R:int(headers[i].R), Data: payload }
+			trk.Sectors[i] = sector{ R:int(headers[i].R), N: headers[i].N, ST1: headers[i].ST1, ST2: headers[i].ST2, Data: payload }
 			trk.ByID[int(headers[i].R)] = &trk.Sectors[i]
 		}
-		// Skip padding to declared track size
-		pad := size - read
-		if pad > 0 { _, _ = readExactly(f, pad) }
-		// Map t back to cylinder (SS: t==cyl)
-		cyl := t
-		if cyl < len(d.Tracks) { d.Tracks[cyl] = trk }
+		if err := nextTrack(f, path, t, size, read, warn); err != nil { return nil, fmt.Errorf("track %d: %w", t, err) }
+		// Keep the record order: cylinder-major, side 0 before side 1 (SS: t==cyl)
+		d.Tracks[t] = trk
 	}
-
+	settleIDs(d)
 	return d, nil
 }
 
+// mixedSizeTracks lists the track records whose sectors do not all share one size code (N).
+// Blocks are read as byte runs in sector ID order, which only holds if the sizes mix
+// the way the format expects.
+func mixedSizeTracks(d *disk) []int {
+	var out []int
+	for t, trk := range d.Tracks {
+		for _, s := range trk.Sectors {
+			if s.N != trk.Sectors[0].N { out = append(out, t); break }
+		}
+	}
+	return out
+}
+
 // --- +3 helpers ---
 func specT0S1(d *disk) []byte {
-	if len(d.Tracks) == 0 { return nil }
-	s := d.Tracks[0].ByID[1]; if s == nil || len(s.Data) < 16 { return nil }
-	return s.Data[:16]
+	if len(d.Tracks) == 0 || len(d.Tracks[0].Sectors) == 0 { return nil }
+	trk := d.Tracks[0]
+	// The spec lives in the lowest-numbered sector; failing that, try the physically first
+	// one, which is where some PCW disks keep it under another sector ID.
+	var spec []byte
+	if s := trk.ByID[trackBase(d, 0)]; s != nil && len(s.Data) >= 16 { spec = s.Data[:16] }
+	if s := &trk.Sectors[0]; !looksPlus3Spec(spec) && len(s.Data) >= 16 && looksPlus3Spec(s.Data[:16]) { spec = s.Data[:16] }
+	return spec
 }
+// looksPlus3Spec recognises a +3/PCW disk spec of any disk type in the +3/PCW table (type 0
+// CF2 or type 3 CF2DD; sidedness in bits 0-1 of byte 1, bit 7 set for double-track drives).
 func looksPlus3Spec(b []byte) bool {
-	return b!=nil && len(b)>=16 && b[0]==0 && (b[1]==0||b[1]==1) && b[2]>=40 && b[3]>=9 && b[4]==2 && b[6]==3 && b[7]==2
+	return b!=nil && len(b)>=16 && (b[0]==0||b[0]==3) && b[1]&0x7C==0 && b[1]&3!=3 &&
+		b[2]>=40 && b[3]>=8 && b[4]==2 && b[6]>=3 && b[6]<=7 && b[7]>=1
 }
 
-type dirEntry struct{ User byte; Name, Ext string; EX,S1,S2,RC byte; Blocks []byte }
+// standardLayout reports whether the extractor understands a spec's layout: blocks, of
+// whatever size BSH gives, that directory entries can number in 8 or 16 bits.
+func standardLayout(b []byte) bool {
+	sides := 1
+	if b[1]&3 != 0 { sides = 2 }
+	blocks := (int(b[2])*sides - int(b[5])) * int(b[3]) * (128 << b[4]) / (128 << b[6])
+	return blocks <= 0x10000
+}
+
+// isDoubleStepped reports whether an image stores a 40-track disk on 80 physical
+// tracks: every odd track is either unformatted or a copy of the even track before it.
+// A +3 spec that claims more tracks than the halved count rules it out.
+func isDoubleStepped(d *disk) bool {
+	n := len(d.Tracks)
+	if d.sides != 1 || n < 80 || n%2 != 0 { return false }
+	if spec := specT0S1(d); looksPlus3Spec(spec) && int(spec[2]) > n/2 { return false }
+	for t := 1; t < n; t += 2 {
+		if len(d.Tracks[t].Sectors) != 0 && !sameTrack(d.Tracks[t], d.Tracks[t-1]) { return false }
+	}
+	return true
+}
+func sameTrack(a, b track) bool {
+	if len(a.Sectors) != len(b.Sectors) { return false }
+	for i := range a.Sectors {
+		if a.Sectors[i].R != b.Sectors[i].R || !bytes.Equal(a.Sectors[i].Data, b.Sectors[i].Data) { return false }
+	}
+	return true
+}
+// doubleStep keeps every other physical track (0, 2, 4, ...) as the logical tracks.
+func doubleStep(d *disk) {
+	var trs []track
+	for t := 0; t < len(d.Tracks); t += 2 { trs = append(trs, d.Tracks[t]) }
+	d.Tracks = trs; d.tracks = len(trs)
+	settleIDs(d)
+}
+
+type dirEntry struct{ User byte; Name, Ext string; Attr byte; EX,S1,S2,RC byte; Blocks []int; Slot int }
+
+// size is the number of bytes an entry's records cover: the full logical extents
+// before the last one (EX & exm of them) plus the RC records of the last.
+func (e dirEntry) size(exm byte) int { return (int(e.EX&exm)*128 + int(e.RC)) * 128 }
+
+// CP/M file attributes, carried in the high bits of the three extension bytes.
+const (
+	attrReadOnly = 1 << iota // t1'
+	attrSystem               // t2'
+	attrArchive              // t3'
+)
+
+// strip7 clears the attribute bits CP/M keeps in the high bit of name bytes.
+func strip7(b []byte) string {
+	out := make([]byte, len(b))
+	for i, c := range b { out[i] = c & 0x7F }
+	return string(out)
+}
+
+// idRun reports whether a track's sector IDs, each counted once, run without a gap,
+// and from which ID and how many.
+func idRun(trk track) (lo, n int, ok bool) {
+	if len(trk.Sectors) == 0 { return 0, 0, false }
+	lo, hi := trk.Sectors[0].R, trk.Sectors[0].R
+	for _, s := range trk.Sectors { lo, hi = min(lo, s.R), max(hi, s.R) }
+	return lo, len(trk.ByID), hi-lo+1 == len(trk.ByID)
+}
+
+// settleIDs works out once for the disk the sector ID its tracks number from: 1 on +3
+// disks, 0 or 0x41 on some CPC and PCW formats. It is the run most gapless tracks share.
+func settleIDs(d *disk) {
+	type run struct{ lo, n int }
+	count := map[run]int{}
+	best := run{1, 0}
+	for _, trk := range d.Tracks {
+		lo, n, ok := idRun(trk); if !ok { continue }
+		r := run{lo, n}; count[r]++
+		if count[r] > count[best] { best = r }
+	}
+	d.idBase, d.idSpan = best.lo, best.n
+}
+
+// trackBase is the ID a track's sectors run up from; locate counts sectors 1..N and the
+// n-th has ID trackBase+n-1. A track keeps a base of its own only when its IDs are a
+// full gapless run; one that lost or renamed a sector reads from the disk's base, so the
+// sector that is gone is reported instead of every later one shifting down by one.
+func trackBase(d *disk, tr int) int {
+	if lo, n, ok := idRun(d.Tracks[tr]); ok && n == d.idSpan { return lo }
+	return d.idBase
+}
+
+// pickSector returns the best copy of sector R on a track: protected tracks can carry
+// several sectors with the same ID, so prefer a full-size copy without ST error flags.
+func pickSector(trk track, r, size int) *sector {
+	var best *sector
+	score := func(s *sector) int {
+		n := 0
+		if len(s.Data) == size { n += 2 }
+		if s.ST1 == 0 && s.ST2 == 0 { n++ }
+		return n
+	}
+	for i := range trk.Sectors {
+		s := &trk.Sectors[i]
+		if s.R == r && (best == nil || score(s) > score(best)) { best = s }
+	}
+	return best
+}
+
+// layout describes how the data area is laid over the image's tracks.
+type layout struct {
+	reserved, spt int  // reserved (system) tracks, sectors per track
+	sides, cyls   int
+	successive    bool // double-sided, side 1 follows all of side 0 (else sides alternate)
+	secSize       int  // bytes per sector
+	blockSize     int  // bytes per allocation block
+	dirBlocks     int  // blocks reserved for the directory
+}
+
+// blockSectors is the number of sectors in one allocation block.
+func (l layout) blockSectors() int { return l.blockSize / l.secSize }
+
+// dataBlocks is the number of allocation blocks the formatted data area holds, directory included.
+func (l layout) dataBlocks() int { return (l.cyls*l.sides - l.reserved) * l.spt * l.secSize / l.blockSize }
+
+// wide reports whether directory entries list 16-bit block numbers (eight little-endian
+// words) rather than sixteen bytes, as CP/M does on disks of more than 256 blocks.
+func (l layout) wide() bool { return l.dataBlocks() > 256 }
+
+// extentMask is CP/M's EXM: a directory entry's block numbers hold (EXM+1) 16KB
+// logical extents, so with 2KB blocks and 8-bit numbers one entry covers two of them.
+func (l layout) extentMask() byte {
+	per := 16
+	if l.wide() { per = 8 }
+	if l.blockSize*per < 16384 { return 0 } // CP/M does not allow blocks under 1KB; -geometry can
+	return byte(l.blockSize*per/16384 - 1)
+}
+
+// layoutOf derives the layout from the +3 spec, falling back to the 180K +3 layout
+// over the image's tracks. The data area is as long as the spec's track count says,
+// however many tracks the image holds; zx3info derives it the same way. A single-sided
+// image is read single-sided whatever sidedness the spec claims. A -geometry override
+// wins over both.
+func layoutOf(d *disk) layout {
+	if d.forced != nil { return *d.forced }
+	l := layout{reserved: 1, spt: 9, sides: 1, cyls: d.tracks, secSize: 512, blockSize: 1024, dirBlocks: 2}
+	if spec := specT0S1(d); looksPlus3Spec(spec) {
+		l.cyls, l.reserved, l.spt = int(spec[2]), int(spec[5]), int(spec[3])
+		l.secSize, l.blockSize, l.dirBlocks = 128<<spec[4], 128<<spec[6], int(spec[7])
+		if d.sides == 2 && spec[1]&3 != 0 { l.sides, l.successive = 2, spec[1]&3 == 2 }
+	}
+	return l
+}
+
+// parseGeometry reads a -geometry value: tracks x sides x sectors x sector-size x
+// reserved-tracks x block-size, optionally followed by x dir-blocks (default 2).
+// Two sides are taken to alternate, as on the PCW and +3.
+func parseGeometry(s string) (*layout, error) {
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 6 && len(parts) != 7 {
+		return nil, fmt.Errorf("want TRACKSxSIDESxSECTORSxSECSIZExRESERVEDxBLOCK[xDIRBLOCKS], got %q", s)
+	}
+	v := make([]int, 7)
+	v[6] = 2
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 { return nil, fmt.Errorf("bad number %q in %q", p, s) }
+		v[i] = n
+	}
+	l := &layout{cyls: v[0], sides: v[1], spt: v[2], secSize: v[3], reserved: v[4], blockSize: v[5], dirBlocks: v[6]}
+	switch {
+	case l.cyls == 0 || l.spt == 0:
+		return nil, fmt.Errorf("tracks and sectors must be non-zero")
+	case l.sides != 1 && l.sides != 2:
+		return nil, fmt.Errorf("sides must be 1 or 2, got %d", l.sides)
+	case l.secSize < 128 || l.secSize&(l.secSize-1) != 0:
+		return nil, fmt.Errorf("sector size %d is not a power of two of at least 128", l.secSize)
+	case l.blockSize < l.secSize || l.blockSize%l.secSize != 0:
+		return nil, fmt.Errorf("block size %d is not a multiple of the %d-byte sector", l.blockSize, l.secSize)
+	case l.dirBlocks < 1 || l.dirBlocks > 16:
+		return nil, fmt.Errorf("directory blocks must be 1..16, got %d", l.dirBlocks)
+	case l.reserved >= l.cyls*l.sides:
+		return nil, fmt.Errorf("%d reserved tracks leave no data area", l.reserved)
+	}
+	return l, nil
+}
+
+// locate maps the n-th sector of the data area (0-based) to a track record and logical
+// sector number 1..spt (see trackBase for the ID).
+// Logical tracks count the reserved tracks; alternate-sided disks number them
+// cyl0/side0, cyl0/side1, ... like the records, successive ones run up side 0 and then side 1.
+func (l layout) locate(n int) (rec, r int) {
+	lt := l.reserved + n/l.spt
+	r = n%l.spt + 1
+	switch {
+	case l.sides == 1 || !l.successive:
+		rec = lt
+	case lt < l.cyls:
+		rec = lt * 2
+	default:
+		rec = (lt-l.cyls)*2 + 1
+	}
+	return rec, r
+}
 
+// secLoc is a sector position: track record index and sector ID.
+type secLoc struct{ rec, r int }
+
+// dirLocations lists every directory sector named by the AL0/AL1 bitmap, in directory
+// order. It is the one place the directory's extent is worked out: dirSectors and
+// dirDuplicates both read it.
+func dirLocations(l layout, al uint16) []secLoc {
+	var locs []secLoc
+	for b := 0; b < 16; b++ {
+		if !isDirBlock(al, b) { continue }
+		for i := 0; i < l.blockSectors(); i++ {
+			rec, r := l.locate(b*l.blockSectors() + i)
+			locs = append(locs, secLoc{rec, r})
+		}
+	}
+	return locs
+}
+
+// commonSize is the sector size (from N) most sectors on a track declare.
+func commonSize(trk track) int {
+	count := map[int]int{}
+	best := 512
+	for _, s := range trk.Sectors {
+		size := 128 << (s.N & 7)
+		count[size]++
+		if count[size] > count[best] { best = size }
+	}
+	return best
+}
+
+// trackBytes reads n bytes starting off bytes into track record tr, taking its sectors in
+// ID order (trackBase upwards) as one run. Offsets come from the layout's sector size, so a
+// directory track of 256-byte sectors still reads right beside 512-byte data tracks.
+func trackBytes(d *disk, tr, off, n int) ([]byte, error) {
+	if tr >= len(d.Tracks) { return nil, fmt.Errorf("track %d OOR", tr) }
+	trk := d.Tracks[tr]
+	want := commonSize(trk)
+	out := make([]byte, 0, n)
+	pos := 0
+	for id := trackBase(d, tr); len(out) < n; id++ {
+		s := pickSector(trk, id, want)
+		if s == nil && pos+want <= off { pos += want; continue } // a missing sector before off only costs its place
+		if s == nil { return nil, fmt.Errorf("missing sector T%d R%d", tr, id) }
+		size := 128 << (s.N & 7)
+		if len(s.Data) < size { return nil, fmt.Errorf("sector T%d R%d len=%d (N=%d declares %d)", tr, id, len(s.Data), s.N, size) }
+		if pos+size > off {
+			from := max(off-pos, 0)
+			out = append(out, s.Data[from:min(size, from+n-len(out))]...)
+		}
+		pos += size
+	}
+	return out, nil
+}
+
+// dirDuplicates lists the directory sector IDs that occur more than once on their track.
+// It uses the bitmap dirSectors recorded in d.
+func dirDuplicates(d *disk) []int {
+	var dups []int
+	for _, loc := range dirLocations(layoutOf(d), d.dirAL) {
+		if loc.rec >= len(d.Tracks) { continue }
+		n := 0
+		id := trackBase(d, loc.rec) + loc.r - 1
+		for _, s := range d.Tracks[loc.rec].Sectors { if s.R == id { n++ } }
+		if n > 1 { dups = append(dups, id) }
+	}
+	return dups
+}
+
+// dirAllocation returns the AL0/AL1 directory bitmap (AL0 in the high byte, top bit = block 0)
+// that +3DOS builds from the layout's directory block count.
+func dirAllocation(n int) uint16 {
+	if n > 16 { n = 16 }
+	return ^uint16(0) << (16 - n)
+}
+
+// isDirBlock reports whether block is reserved for the directory by the AL0/AL1 bitmap.
+func isDirBlock(al uint16, block int) bool { return block < 16 && al&(0x8000>>block) != 0 }
+
+// dirSectors reads the directory blocks named by the AL0/AL1 bitmap and records it in d.
+// Each piece is cut from the directory track's own sectors, whatever size those are.
 func dirSectors(d *disk) ([][]byte, error) {
-	if len(d.Tracks) < 2 { return nil, errors.New("no track 1") }
-	tr1 := d.Tracks[1]; secs := make([][]byte, 4)
-	for i := 1; i <= 4; i++ {
-		s := tr1.ByID[i]; if s == nil { return nil, fmt.Errorf("missing directory R%d", i) }
-		if len(s.Data) != 512 { return nil, fmt.Errorf("directory R%d len=%d (need 512)", i, len(s.Data)) }
-		secs[i-1] = s.Data
+	l := layoutOf(d)
+	d.dirAL = dirAllocation(l.dirBlocks)
+	var secs [][]byte
+	for _, loc := range dirLocations(l, d.dirAL) {
+		if loc.rec >= len(d.Tracks) { return nil, fmt.Errorf("directory sector OOR (tr=%d)", loc.rec) }
+		b, err := trackBytes(d, loc.rec, (loc.r-1)*l.secSize, l.secSize); if err != nil { return nil, fmt.Errorf("directory: %w", err) }
+		secs = append(secs, b)
 	}
+	if len(secs) == 0 { return nil, errors.New("spec reserves no directory blocks") }
 	return secs, nil
 }
 
-func parseDir(secs [][]byte) []dirEntry {
+// plausibleEntry reports whether a 32-byte slot is free (0xE5) or could be a real
+// directory entry: user 0..31 or a CP/M 3 label (0x20), printable 7-bit name, and
+// in-range EX and RC. CP/M 3 datestamp slots (0x21) hold binary and always pass; a
+// label's EX byte holds its flags and is not checked.
+func plausibleEntry(e []byte) bool {
+	if e[0] == 0xE5 || e[0] == 0x21 { return true }
+	if e[0] > 0x20 || (e[0] < 0x20 && (e[12] > 31 || e[15] > 0x80)) { return false }
+	for _, c := range e[1:12] {
+		if c &= 0x7F; c < 0x20 || c == 0x7F { return false }
+	}
+	return true
+}
+
+// dirSectorScore returns how many live entries a sector holds, or -1 if any slot is implausible.
+func dirSectorScore(b []byte) int {
+	if len(b) == 0 || len(b)%32 != 0 { return -1 }
+	live := 0
+	for i := 0; i < len(b); i += 32 {
+		if !plausibleEntry(b[i:i+32]) { return -1 }
+		if b[i] != 0xE5 { live++ }
+	}
+	return live
+}
+
+// dirLooksValid reports whether every directory sector holds only plausible entries.
+func dirLooksValid(secs [][]byte) bool {
+	for _, b := range secs {
+		if dirSectorScore(b) < 0 { return false }
+	}
+	return true
+}
+
+// scanForDirectory is the fallback when the primary directory is unreadable or corrupt:
+// it searches every sector of the first data track, in ID order and including duplicate
+// IDs, for ones that look like directory sectors with at least one live entry.
+// It returns those sectors and their IDs.
+func scanForDirectory(d *disk) ([][]byte, []int) {
+	rec, _ := layoutOf(d).locate(0)
+	if rec >= len(d.Tracks) { return nil, nil }
+	ss := append([]sector(nil), d.Tracks[rec].Sectors...)
+	sort.SliceStable(ss, func(i, j int) bool { return ss[i].R < ss[j].R })
+	var secs [][]byte
+	var ids []int
+	seen := map[string]bool{}
+	for _, s := range ss {
+		if dirSectorScore(s.Data) <= 0 || seen[string(s.Data)] { continue }
+		seen[string(s.Data)] = true
+		secs = append(secs, s.Data)
+		ids = append(ids, s.R)
+	}
+	return secs, ids
+}
+
+// parseDir decodes the live entries of the directory sectors; wide entries list eight
+// 16-bit block numbers instead of sixteen 8-bit ones.
+func parseDir(secs [][]byte, wide bool) []dirEntry {
 	buf := bytes.Join(secs, nil); var out []dirEntry
 	for i:=0; i+32 <= len(buf); i+=32 {
-		e := buf[i:i+32]; if e[0] == 0xE5 { continue }
+		e := buf[i:i+32]; if e[0] == 0xE5 || e[0] == 0x20 || e[0] == 0x21 { continue } // unused, the CP/M 3 disk label or datestamps
+		var attr byte
+		for j := 0; j < 3; j++ {
+			if e[9+j]&0x80 != 0 { attr |= 1 << j }
+		}
+		var blocks []int
+		for j := 16; j < 32; j++ {
+			if wide { blocks = append(blocks, int(binary.LittleEndian.Uint16(e[j:]))); j++; continue }
+			blocks = append(blocks, int(e[j]))
+		}
 		out = append(out, dirEntry{
 			User: e[0],
-			Name: strings.TrimRight(string(e[1:9]), " "),
-			Ext:  strings.TrimRight(string(e[9:12]), " "),
+			Name: strings.TrimRight(strip7(e[1:9]), " "),
+			Ext:  strings.TrimRight(strip7(e[9:12]), " "),
+			Attr: attr,
 			EX:e[12], S1:e[13], S2:e[14], RC:e[15],
-			Blocks: append([]byte(nil), e[16:32]...),
+			Blocks: blocks,
+			Slot: i/32,
 		})
 	}
 	return out
 }
 
-type extentKey struct{ EX, S1 byte }
-type fileAgg struct{ User byte; Name, Ext string; Extents map[extentKey]dirEntry; Order []extentKey; TotalBytes int }
+// extentNumber returns the logical extent number of a directory entry:
+// EX holds the low 5 bits and S2 the extent module (high-order bits), per CP/M 2.2.
+func extentNumber(e dirEntry) int { return int(e.S2&0x3F)<<5 | int(e.EX&0x1F) }
+
+type extentKey struct{ EX, S2 byte }
+type fileAgg struct{ User byte; Name, Ext string; Attr byte; Extents map[extentKey]dirEntry; Order []extentKey; TotalBytes int; Conflicts []ExtentConflict; FirstSlot int }
+
+// ExtentConflict records two directory entries of one file claiming the same extent number.
+// The entry with the higher RC wins; on a tie the later directory slot wins.
+type ExtentConflict struct {
+	Extent      int `json:"extent"`
+	KeptSlot    int `json:"kept_slot"`
+	KeptRC      int `json:"kept_rc"`
+	DroppedSlot int `json:"dropped_slot"`
+	DroppedRC   int `json:"dropped_rc"`
+}
 
-func aggregate(entries []dirEntry) []fileAgg {
+// dedupExtents drops entries that repeat an extent number (list must be sorted by extent number),
+// keeping the higher RC or, on a tie, the later directory slot.
+func dedupExtents(list []dirEntry) ([]dirEntry, []ExtentConflict) {
+	var out []dirEntry
+	var conflicts []ExtentConflict
+	for _, e := range list {
+		n := len(out)
+		if n == 0 || extentNumber(out[n-1]) != extentNumber(e) { out = append(out, e); continue }
+		keep, drop := out[n-1], e
+		if e.RC > keep.RC || (e.RC == keep.RC && e.Slot > keep.Slot) { keep, drop = e, out[n-1] }
+		out[n-1] = keep
+		conflicts = append(conflicts, ExtentConflict{
+			Extent: extentNumber(e),
+			KeptSlot: keep.Slot, KeptRC: int(keep.RC),
+			DroppedSlot: drop.Slot, DroppedRC: int(drop.RC),
+		})
+	}
+	return out, conflicts
+}
+
+func aggregate(entries []dirEntry, exm byte) []fileAgg {
 	type key struct{ User byte; Name, Ext string }
 	group := map[key][]dirEntry{}
 	for _, e := range entries {
@@ -164,22 +626,23 @@ func aggregate(entries []dirEntry) []fileAgg {
 	}
 	var out []fileAgg
 	for k, list := range group {
-		// order by (S1<<5)|(EX&0x1F)
-		sort.Slice(list, func(i,j int) bool {
-			ai := int(list[i].S1)<<5 | int(list[i].EX&0x1F)
-			aj := int(list[j].S1)<<5 | int(list[j].EX&0x1F)
-			return ai < aj
-		})
+		// order by (S2<<5)|(EX&0x1F)
+		sort.Slice(list, func(i,j int) bool { return extentNumber(list[i]) < extentNumber(list[j]) })
+		list, conflicts := dedupExtents(list)
 		m := make(map[extentKey]dirEntry)
 		var ord []extentKey
 		total := 0
+		var attr byte
+		first := -1
+		for _, e := range group[k] { if first < 0 || e.Slot < first { first = e.Slot } }
 		for _, e := range list {
-			kx := extentKey{EX:e.EX, S1:e.S1}
+			attr |= e.Attr
+			kx := extentKey{EX:e.EX, S2:e.S2}
 			m[kx] = e
 			ord = append(ord, kx)
-			total += int(e.RC) * 128
+			total += e.size(exm)
 		}
-		out = append(out, fileAgg{ User:k.User, Name:k.Name, Ext:k.Ext, Extents:m, Order:ord, TotalBytes: total })
+		out = append(out, fileAgg{ User:k.User, Name:k.Name, Ext:k.Ext, Attr:attr, Extents:m, Order:ord, TotalBytes: total, Conflicts: conflicts, FirstSlot: first })
 	}
 	// stable order
 	sort.Slice(out, func(i,j int) bool {
@@ -190,48 +653,124 @@ func aggregate(entries []dirEntry) []fileAgg {
 	return out
 }
 
+// filesNamed keeps the files whose 8.3 name is name, ignoring case; "NAME" or "NAME."
+// picks a file without an extension. Every user area's copy is kept.
+func filesNamed(files []fileAgg, name string) []fileAgg {
+	base, ext, _ := strings.Cut(strings.ToUpper(name), ".")
+	var out []fileAgg
+	for _, f := range files {
+		if strings.TrimRight(f.Name, " ") == base && strings.TrimRight(f.Ext, " ") == ext { out = append(out, f) }
+	}
+	return out
+}
+
+// wildMatch83 matches a CP/M wildcard against a file's name and extension, field by
+// field as CCP does: each side of the dot is padded to 8 (or 3) characters, '?' takes
+// any character including the padding and '*' fills the rest of its field with '?'.
+// A pattern without a dot matches only files without an extension. Case is ignored.
+func wildMatch83(pattern, name, ext string) bool {
+	pb, pe, _ := strings.Cut(strings.ToUpper(pattern), ".")
+	field := func(p, s string, n int) bool {
+		if i := strings.IndexByte(p, '*'); i >= 0 { p = p[:i] + strings.Repeat("?", max(0, n-i)) }
+		p, s = fmt.Sprintf("%-*s", n, p), fmt.Sprintf("%-*s", n, strings.ToUpper(s))
+		if len(p) != n || len(s) != n { return false } // longer than the field: no 8.3 name matches
+		for i := 0; i < n; i++ {
+			if p[i] != '?' && p[i] != s[i] { return false }
+		}
+		return true
+	}
+	return field(pb, strings.TrimRight(name, " "), 8) && field(pe, strings.TrimRight(ext, " "), 3)
+}
+
+// sortBySlot puts files in the order their first directory entry appears on disk.
+func sortBySlot(files []fileAgg) {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].FirstSlot < files[j].FirstSlot })
+}
+
 // Map absolute block number (0-based from start of data area) to bytes from the disk image.
-// Data area starts at Track 1, Sector 1.
+// The data area starts after the reserved tracks; layoutOf supplies the geometry. Sectors
+// are taken as byte ranges of their track, so tracks of another sector size read the same.
 func getBlock(d *disk, block int) ([]byte, error) {
-	// 1KB block = 2 sectors of 512
-	startTr, startSe := 1, 1
-	// add block*2 sectors
-	advance := block * 2
-	tr, se := startTr, startSe
-	for advance > 0 {
-		se++
-		if se > 9 { se = 1; tr++ }
-		advance--
-	}
-	// read two sectors
+	l := layoutOf(d)
 	var out bytes.Buffer
-	for i := 0; i < 2; i++ {
+	for i := 0; i < l.blockSectors(); i++ {
+		tr, se := l.locate(block*l.blockSectors() + i)
 		if tr >= len(d.Tracks) { return nil, fmt.Errorf("block %d OOR (tr=%d)", block, tr) }
-		sec := d.Tracks[tr].ByID[se]
-		if sec == nil { return nil, fmt.Errorf("missing sector T%d R%d", tr, se) }
-		if len(sec.Data) != 512 { return nil, fmt.Errorf("sector T%d R%d len=%d", tr, se, len(sec.Data)) }
-		out.Write(sec.Data)
-		// advance to next sector
-		se++
-		if se > 9 { se = 1; tr++ }
+		b, err := trackBytes(d, tr, (se-1)*l.secSize, l.secSize); if err != nil { return nil, err }
+		out.Write(b)
+	}
+	return out.Bytes(), nil
+}
+
+// freeBlocks lists, in ascending order, the data-area blocks that are neither directory
+// blocks nor referenced by a live (user 0..15) directory entry.
+func freeBlocks(d *disk, entries []dirEntry) []int {
+	l := layoutOf(d)
+	total := l.dataBlocks()
+	used := make([]bool, total)
+	for _, e := range entries {
+		if e.User > 15 { continue }
+		for _, b := range e.Blocks { if int(b) < total { used[b] = true } }
+	}
+	var free []int
+	for b := 0; b < total; b++ {
+		if !used[b] && !isDirBlock(d.dirAL, b) { free = append(free, b) }
+	}
+	return free
+}
+
+// dumpFreeBlocks writes the raw contents of every free block to path, back to back in
+// block order, for carving deleted data. An unreadable block is written as zeros so
+// later blocks keep their offsets, with a warning to warn. It returns the number of
+// blocks written.
+func dumpFreeBlocks(d *disk, entries []dirEntry, path string, warn io.Writer) (int, error) {
+	var out bytes.Buffer
+	free := freeBlocks(d, entries)
+	size := layoutOf(d).blockSize
+	for _, b := range free {
+		chunk, err := getBlock(d, b)
+		if err != nil {
+			fmt.Fprintf(warn, "Warning: free block %d unreadable (%v); writing zeros at offset %d\n", b, err, out.Len())
+			chunk = make([]byte, size)
+		}
+		out.Write(chunk)
+	}
+	return len(free), os.WriteFile(path, out.Bytes(), 0644)
+}
+
+// readPhysical concatenates a file's blocks in ascending block-number order, ignoring the
+// logical extent order, and trims to the RC-derived length. Debugging aid for -physical only.
+func readPhysical(d *disk, exts []ExtentMeta, total int) ([]byte, error) {
+	var all []int
+	for _, e := range exts { all = append(all, e.Blocks...) }
+	sort.Ints(all)
+	var out bytes.Buffer
+	for _, b := range all {
+		chunk, err := getBlock(d, b); if err != nil { return out.Bytes(), err }
+		out.Write(chunk)
 	}
+	if total < out.Len() { out.Truncate(total) }
 	return out.Bytes(), nil
 }
 
 // +3DOS header metadata container
 type Plus3Header struct {
-	Signature   string `json:"signature"`
-	Issue       uint8  `json:"issue"`
-	Version     uint8  `json:"version"`
-	TotalLength int    `json:"total_length"`
-	Type        uint8  `json:"type"`
-	BasicType   string `json:"basic_type"`
-	DataLength  int    `json:"data_length"`
-	Param1      int    `json:"param1"`
-	Param2      int    `json:"param2"`
-	Checksum    uint8  `json:"checksum"`
-	ChecksumOK  bool   `json:"checksum_ok"`
-	LoadAddress int    `json:"load_address,omitempty"`
+	Signature   string      `json:"signature"`
+	Issue       uint8       `json:"issue"`
+	Version     uint8       `json:"version"`
+	IssueVerOK  bool        `json:"issue_version_standard"`
+	TotalLength uint32      `json:"total_length"`
+	TotalLenOK  bool        `json:"total_length_ok"`
+	Type        uint8       `json:"type"`
+	BasicType   string      `json:"basic_type"`
+	DataLength  int         `json:"data_length"`
+	Param1      int         `json:"param1"`
+	Param2      int         `json:"param2"`
+	Checksum    uint8       `json:"checksum"`
+	ChecksumOK  bool        `json:"checksum_ok"`
+	LoadAddress int         `json:"load_address,omitempty"`
+	CodeKind    string      `json:"code_kind,omitempty"`
+	Basic       *BasicCheck `json:"basic_check,omitempty"` // type 0 only
 }
 
 // Detect +3DOS header and (optionally) strip it. Returns data, header meta (or nil), and a boolean indicating header presence.
@@ -242,7 +781,7 @@ func peelPlus3Header(b []byte) ([]byte, *Plus3Header, bool) {
 	if h[8] != 0x1A { return b, nil, false }
 	sum := 0
 	for i := 0; i < 127; i++ { sum = (sum + int(h[i])) & 0xFF }
-	totalLen := int(h[11]) | int(h[12])<<8 | int(h[13])<<16 | int(h[14])<<24
+	totalLen := binary.LittleEndian.Uint32(h[11:15]) // uint32: no sign/overflow surprises on 32-bit builds
 	dataLen := int(binary.LittleEndian.Uint16(h[16:18]))
 	p1 := int(binary.LittleEndian.Uint16(h[18:20]))
 	p2 := int(binary.LittleEndian.Uint16(h[20:22]))
@@ -250,94 +789,416 @@ func peelPlus3Header(b []byte) ([]byte, *Plus3Header, bool) {
 	btype := map[byte]string{0:"program",1:"numeric_array",2:"char_array",3:"code_or_screen"}[typ]
 	meta := &Plus3Header{
 		Signature: "PLUS3DOS",
-		Issue: h[9], Version: h[10],
+		Issue: h[9], Version: h[10], IssueVerOK: h[9] == 1 && h[10] == 0, // every +3DOS release writes issue 1, version 0
 		TotalLength: totalLen,
 		Type: typ, BasicType: btype,
 		DataLength: dataLen, Param1: p1, Param2: p2,
 		Checksum: h[127], ChecksumOK: byte(sum) == h[127],
 	}
-	if typ == 3 { meta.LoadAddress = p1 }
-	if totalLen < 128 || dataLen < 0 || totalLen-128 < dataLen {
-		// suspicious, but still treat as header and return best-effort
-	}
+	if typ == 3 { meta.LoadAddress = p1; meta.CodeKind = codeKind(dataLen, p1) }
+	// TotalLength must cover the header plus DataLength and fit in the bytes actually on disk;
+	// anything else is garbage: flag it, still treat the header as present (best-effort).
+	meta.TotalLenOK = totalLen >= 128 && uint64(totalLen)-128 >= uint64(dataLen) && uint64(totalLen) <= uint64(len(b))
 	if 128+dataLen > len(b) { dataLen = len(b)-128 }
+	if typ == 0 { meta.Basic = checkBasic(b[128:128+dataLen], meta.DataLength, p2) }
 	return b[128:128+dataLen], meta, true
 }
 
+// BasicCheck cross-checks a BASIC program's own structure against its +3DOS header:
+// the program lines, each a 2-byte line number, 2-byte length and body ending in
+// ENTER (0x0D), must run exactly up to Param2 (the start of the variables), and
+// Param2 must not exceed DataLength. A truncated or padded program fails where the
+// header checksum alone would pass.
+type BasicCheck struct {
+	Lines      int    `json:"lines"`       // program lines walked
+	ProgramEnd int    `json:"program_end"` // offset where the line walk stopped
+	OK         bool   `json:"ok"`
+	Problem    string `json:"problem,omitempty"`
+}
+
+// checkBasic walks the program lines of a type-0 file body (data, as present on disk)
+// whose header gives dataLen and vars (Param2, the program length).
+func checkBasic(data []byte, dataLen, vars int) *BasicCheck {
+	c := &BasicCheck{}
+	switch {
+	case vars > dataLen:
+		c.Problem = fmt.Sprintf("program length (param2) %d exceeds data length %d", vars, dataLen)
+		return c
+	case len(data) < dataLen:
+		c.Problem = fmt.Sprintf("file holds %d of the header's %d data bytes", len(data), dataLen)
+		return c
+	}
+	off := 0
+	for off < vars {
+		if off+4 > vars {
+			c.Problem = fmt.Sprintf("partial line header at offset %d", off)
+			break
+		}
+		num := int(data[off])<<8 | int(data[off+1]) // line numbers are big-endian
+		n := int(binary.LittleEndian.Uint16(data[off+2:off+4]))
+		if num > 9999 {
+			c.Problem = fmt.Sprintf("line number %d out of range at offset %d", num, off)
+			break
+		}
+		if n == 0 || off+4+n > vars {
+			c.Problem = fmt.Sprintf("line %d (length %d) at offset %d runs past the program end %d", num, n, off, vars)
+			break
+		}
+		if data[off+4+n-1] != 0x0D {
+			c.Problem = fmt.Sprintf("line %d at offset %d does not end in ENTER", num, off)
+			break
+		}
+		off += 4 + n
+		c.Lines++
+	}
+	c.ProgramEnd = off
+	c.OK = c.Problem == ""
+	return c
+}
+
+// codeKind classifies a type-3 (CODE) file: a 6912-byte block loaded at 0x4000 is a SCREEN$.
+func codeKind(dataLen, load int) string {
+	if dataLen == 6912 && load == 0x4000 { return "screen" }
+	return "code"
+}
+
+// trimText cuts b at the CP/M end-of-file mark: its first ^Z (0x1A), when the rest of
+// that 128-byte record is ^Z padding too and the whole file, padding aside, looks like
+// text (at least 95% printable ASCII, tab, CR or LF). ok is false for anything else.
+func trimText(b []byte) (out []byte, ok bool) {
+	i := bytes.IndexByte(b, 0x1A)
+	if i <= 0 { return nil, false }
+	end := min(len(b), (i/128+1)*128)
+	for _, c := range b[i:end] { if c != 0x1A { return nil, false } }
+	printable := 0
+	for _, c := range append(b[:i:i], b[end:]...) {
+		if (c >= 0x20 && c < 0x7F) || c == '\t' || c == '\r' || c == '\n' { printable++ }
+	}
+	if printable*100 < (len(b)-(end-i))*95 { return nil, false }
+	return b[:i], true
+}
+
 type ExtentMeta struct {
-	Extent int    `json:"extent"`
-	RC     int    `json:"rc"`
-	Blocks []int  `json:"blocks"`
+	Extent          int   `json:"extent"`
+	RC              int   `json:"rc"`
+	Blocks          []int `json:"blocks"`
+	RCExceedsBlocks bool  `json:"rc_exceeds_blocks"` // RC claims more records than the blocks hold
+	OutOfRange      []int `json:"out_of_range_blocks,omitempty"` // listed blocks past the data area, written as zeros
+	Unreadable      []int `json:"unreadable_blocks,omitempty"` // listed blocks that failed to read, written as zeros
+	MissingBlocks   bool  `json:"missing_blocks,omitempty"` // RC > 0 but every block number is zero: the records are lost
+}
+
+
+// Manifest is the -manifest-only output: every file's metadata, as -meta would write
+// it, in one document. CRC32 is always filled in.
+type Manifest struct {
+	Image string     `json:"image"`
+	Files []FileMeta `json:"files"`
 }
 
 type FileMeta struct {
-	User       int          `json:"user"`
-	Name       string       `json:"name"`
-	Ext        string       `json:"ext"`
-	TotalBytes int          `json:"total_bytes_from_rc"`
-	Extents    []ExtentMeta `json:"extents"`
-	Plus3      *Plus3Header `json:"plus3_header,omitempty"`
-	OutputName string       `json:"output_name"`
-	OutputSize int          `json:"output_size"`
-	HeaderKept bool         `json:"header_kept"`
+	User       int              `json:"user"`
+	Name       string           `json:"name"`
+	Ext        string           `json:"ext"`
+	ReadOnly   bool             `json:"read_only,omitempty"`
+	System     bool             `json:"system,omitempty"`
+	Archive    bool             `json:"archive,omitempty"`
+	TotalBytes int              `json:"total_bytes_from_rc"`
+	Extents    []ExtentMeta     `json:"extents"`
+	Plus3      *Plus3Header     `json:"plus3_header,omitempty"`
+	OutputName string           `json:"output_name"`
+	OutputSize int              `json:"output_size"`
+	HeaderKept bool             `json:"header_kept"`
+	Conflicts  []ExtentConflict `json:"extent_conflicts,omitempty"`
+	Physical   bool             `json:"physical_order,omitempty"`
+	CRC32      string           `json:"crc32,omitempty"`
 }
 
-func main() {
-	flagKeep := flag.Bool("keepheader", false, "keep +3DOS 128-byte headers (default: strip if present)")
-	flagMeta := flag.Bool("meta", false, "write a .json metadata file alongside each extracted file")
-	flag.Parse()
-	if flag.NArg() != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <image.dsk> <outdir> [-keepheader] [-meta]\n", os.Args[0])
-		os.Exit(2)
+// metaSchema builds a JSON Schema (draft 2020-12) for the -meta output by reflecting
+// over FileMeta and the types it references, so the schema cannot drift from the structs.
+func metaSchema() map[string]any {
+	defs := map[string]any{}
+	root := schemaFor(reflect.TypeOf(FileMeta{}), defs)
+	return map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "zx3extract -meta file metadata",
+		"$ref":    root["$ref"],
+		"$defs":   defs,
 	}
-	image := flag.Arg(0)
-	outdir := flag.Arg(1)
+}
 
-	if err := os.MkdirAll(outdir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Output dir error: %v\n", err)
-		os.Exit(1)
+func schemaFor(t reflect.Type, defs map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), defs)
+	case reflect.Struct:
+		if _, done := defs[t.Name()]; !done {
+			defs[t.Name()] = nil // placeholder guards against recursion
+			props := map[string]any{}
+			required := []string{}
+			for i := 0; i < t.NumField(); i++ {
+				tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+				if tag[0] == "" || tag[0] == "-" { continue }
+				props[tag[0]] = schemaFor(t.Field(i).Type, defs)
+				omit := false
+				for _, o := range tag[1:] { if o == "omitempty" { omit = true } }
+				if !omit { required = append(required, tag[0]) }
+			}
+			defs[t.Name()] = map[string]any{"type": "object", "properties": props, "required": required}
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	case reflect.Slice:
+		// nil slices marshal as null
+		return map[string]any{"type": []string{"array", "null"}, "items": schemaFor(t.Elem(), defs)}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Uint8:
+		return map[string]any{"type": "integer", "minimum": 0, "maximum": 255}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
 	}
+	return map[string]any{}
+}
 
-	d, err := parseDSK(image); if err != nil {
-		fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
-		os.Exit(1)
+// options are the extraction flags; a -batchdir run shares one set between its images.
+type options struct {
+	keepHeader, meta, doubleStep, physical, crc, hdr, split, text, lower, dot bool
+	maxSize, pad, padByte, limit, user                                        int
+	manifest, order, free, match, file                                        string
+	geometry     *layout // -geometry, parsed; nil to detect the layout
+	geometrySpec string  // -geometry as given
+}
+
+// batchResult is how one image of a -batchdir run went: its output and error.
+type batchResult struct {
+	path string
+	out  []byte
+	err  error
+}
+
+// batchExtract extracts every .dsk below root into a folder of the same relative path
+// under outroot, on a pool of GOMAXPROCS workers. One image failing does not stop the
+// rest; the outputs are printed in path order once all have finished, followed by the
+// images that failed. It returns the exit status.
+func batchExtract(root, outroot string, o *options) int {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, de os.DirEntry, err error) error {
+		if err != nil { return err }
+		if de.Type().IsRegular() && strings.EqualFold(filepath.Ext(path), ".dsk") { paths = append(paths, path) }
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-batchdir: %v\n", err)
+		return 1
+	}
+	sort.Strings(paths)
+	results := make([]batchResult, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				rel, _ := filepath.Rel(root, paths[i])
+				var out bytes.Buffer
+				err := extractImage(paths[i], filepath.Join(outroot, strings.TrimSuffix(rel, filepath.Ext(rel))), o, &out, &out)
+				results[i] = batchResult{paths[i], out.Bytes(), err}
+			}
+		}()
+	}
+	for i := range paths { jobs <- i }
+	close(jobs)
+	wg.Wait()
+
+	var failed []batchResult
+	for _, r := range results {
+		fmt.Printf("== %s\n%s", r.path, r.out)
+		if r.err != nil { failed = append(failed, r) }
+	}
+	fmt.Printf("\nExtracted %d of %d image(s) below %s\n", len(paths)-len(failed), len(paths), root)
+	if len(failed) == 0 { return 0 }
+	fmt.Println("Failed:")
+	for _, r := range failed { fmt.Printf("  %s: %v\n", r.path, r.err) }
+	return 1
+}
+
+// extractImage extracts the files of one image into outdir as o asks, writing its
+// progress to stdout and warnings to stderr. It returns an error when the image can't
+// be extracted at all; files that fail are reported and skipped.
+func extractImage(image, outdir string, o *options, stdout, stderr io.Writer) (err error) {
+	manifest := o.manifest != ""
+	if outdir != "" {
+		if err := os.MkdirAll(outdir, 0755); err != nil { return fmt.Errorf("Output dir error: %v", err) }
+	}
+
+	d, err := parseDSK(image, stderr); if err != nil { return fmt.Errorf("Parse error: %v", err) }
+	if g := o.geometry; g != nil {
+		d.forced = g
+		fmt.Fprintf(stderr, "WARNING: -geometry %s overrides layout detection: %d tracks, %d side(s), %d x %d-byte sectors, %d reserved track(s), %d-byte blocks, %d directory block(s); the +3 spec and double-step detection are ignored\n",
+			o.geometrySpec, g.cyls, g.sides, g.spt, g.secSize, g.reserved, g.blockSize, g.dirBlocks)
+		if g.sides != d.sides {
+			fmt.Fprintf(stderr, "WARNING: -geometry gives %d side(s) but the image has %d\n", g.sides, d.sides)
+		}
+		if blocks := g.dataBlocks(); blocks > 256 {
+			fmt.Fprintf(stderr, "WARNING: %d blocks need 16-bit block numbers, but directory entries are read as 8-bit\n", blocks)
+		}
+	}
+	if o.doubleStep || (d.forced == nil && isDoubleStepped(d)) {
+		doubleStep(d)
+		fmt.Fprintf(stderr, "Note: double-stepped image; reading every other track (%d logical tracks)\n", d.tracks)
+	}
+	if mixed := mixedSizeTracks(d); len(mixed) > 0 {
+		fmt.Fprintf(stderr, "Warning: track(s) %v mix sector sizes; their sectors are read in ID order as one run of bytes, so check files there\n", mixed)
 	}
 	// Ensure +3 layout present
 	spec := specT0S1(d)
-	if !looksPlus3Spec(spec) {
-		fmt.Fprintf(os.Stderr, "Warning: not a +3 PCW-180K layout (missing +3 spec at T0,S1). Attempting anyway...\n")
+	if d.forced != nil {
+		// The user has taken responsibility for the layout.
+	} else if !looksPlus3Spec(spec) {
+		fmt.Fprintf(stderr, "Warning: not a +3 PCW-180K layout (missing +3 spec at T0,S1). Attempting anyway...\n")
+	} else if !standardLayout(spec) {
+		return fmt.Errorf("Spec declares %d tracks, sidedness 0x%02X, %d-byte blocks: only layouts with up to 65536 blocks can be extracted",
+			spec[2], spec[1], 128<<spec[6])
 	}
 	secs, err := dirSectors(d)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Directory not found in standard +3 location: %v\n", err)
-		os.Exit(1)
+	if err != nil || !dirLooksValid(secs) {
+		why := "it holds impossible entries"
+		if err != nil { why = err.Error() }
+		found, ids := scanForDirectory(d)
+		switch {
+		case len(found) > 0:
+			rec, _ := layoutOf(d).locate(0)
+			fmt.Fprintf(stderr, "Warning: primary directory unusable (%s); falling back to %d plausible directory sector(s) found on track %d (IDs %v)\n",
+				why, len(found), rec, ids)
+			secs = found
+		case err != nil:
+			return fmt.Errorf("Directory not found in standard +3 location: %v", err)
+		default:
+			fmt.Fprintf(stderr, "Warning: primary directory holds impossible entries and no backup copy was found; using it anyway\n")
+		}
+	}
+	for _, r := range dirDuplicates(d) {
+		fmt.Fprintf(stderr, "Warning: directory track has several R=%d sectors; using the cleanest full-size copy\n", r)
+	}
+	entries := parseDir(secs, layoutOf(d).wide())
+	if o.free != "" {
+		n, err := dumpFreeBlocks(d, entries, o.free, stderr)
+		if err != nil { return fmt.Errorf("-freespace: %v", err) }
+		fmt.Fprintf(stdout, "Wrote %d free block(s) (%d bytes) to %s\n", n, n*layoutOf(d).blockSize, o.free)
+		if outdir == "" && !manifest { return nil }
+	}
+	man := Manifest{Image: image, Files: []FileMeta{}}
+	if manifest {
+		// Written however the loop ends, unless in an error; an empty directory gives an empty list.
+		defer func() {
+			if err != nil { return }
+			js, werr := json.MarshalIndent(man, "", "  ")
+			if werr == nil { werr = os.WriteFile(o.manifest, js, 0644) }
+			if werr != nil { err = fmt.Errorf("Write error %s: %v", o.manifest, werr); return }
+			fmt.Fprintf(stdout, "Wrote manifest of %d file(s) to %s\n", len(man.Files), o.manifest)
+		}()
 	}
-	entries := parseDir(secs)
 	if len(entries) == 0 {
-		fmt.Println("No files found.")
-		return
+		fmt.Fprintln(stdout, "No files found.")
+		return nil
+	}
+	files := aggregate(entries, layoutOf(d).extentMask())
+	if o.user >= 0 {
+		var kept []fileAgg
+		for _, f := range files {
+			if int(f.User) == o.user { kept = append(kept, f) }
+		}
+		fmt.Fprintf(stdout, "%d of %d file(s) in user %d\n", len(kept), len(files), o.user)
+		files = kept
+	}
+	if o.file != "" {
+		files = filesNamed(files, o.file)
+		if len(files) == 0 {
+			return fmt.Errorf("No file %s on %s", strings.ToUpper(o.file), image)
+		}
+	}
+	if o.match != "" {
+		var kept []fileAgg
+		for _, f := range files {
+			if wildMatch83(o.match, f.Name, f.Ext) { kept = append(kept, f) }
+		}
+		fmt.Fprintf(stdout, "%d of %d file(s) match %s\n", len(kept), len(files), strings.ToUpper(o.match))
+		files = kept
+	}
+	if o.order == "slot" { sortBySlot(files) }
+	blockSize, totalBlocks := layoutOf(d).blockSize, layoutOf(d).dataBlocks()
+	maxSize := o.maxSize
+	if maxSize <= 0 { maxSize = totalBlocks * blockSize }
+	if o.physical {
+		fmt.Fprintf(stderr, "DEBUG -physical: files are assembled in ascending block order, NOT logical order; output is for diagnosis only\n")
 	}
-	files := aggregate(entries)
 
+	written := 0
 	for _, f := range files {
+		if o.limit > 0 && written >= o.limit {
+			fmt.Fprintf(stderr, "Stopped after %d file(s) (-limit)\n", written)
+			break
+		}
+		for _, c := range f.Conflicts {
+			fmt.Fprintf(stderr, "Warning: %s.%s has duplicate extent %d (slots %d and %d); using slot %d (RC %d)\n",
+				f.Name, f.Ext, c.Extent, c.KeptSlot, c.DroppedSlot, c.KeptSlot, c.KeptRC)
+		}
+		if f.TotalBytes > maxSize {
+			fmt.Fprintf(stderr, "Error: %s.%s would reassemble to %d bytes, over the -max-file-size limit of %d; skipping\n",
+				f.Name, f.Ext, f.TotalBytes, maxSize)
+			continue
+		}
 		// reconstruct bytes extent-by-extent
 		var assembled bytes.Buffer
 		var extentMetas []ExtentMeta
 		for _, k := range f.Order {
 			e := f.Extents[k]
-			extentNum := int(e.S1)<<5 | int(e.EX&0x1F)
+			extentNum := extentNumber(e)
 			// load each listed block (non-zero bytes indicate block numbers; zero may mean "unused")
 			var extBytes bytes.Buffer
-			var blocks []int
+			blocks := []int{} // a zero-length file's extent lists no blocks: "blocks": [], not null
+			var outOfRange, unreadable []int
+			// A block that can't be read is written as zeros, so the blocks after it keep their offsets.
 			for _, b := range e.Blocks {
 				if b == 0 { continue } // zero indicates no block / padding in entry
+				if int(b) >= totalBlocks {
+					fmt.Fprintf(stderr, "Warning: %s.%s extent %d lists block %d, past the %d-block data area; the entry is corrupt, writing zeros in its place\n",
+						f.Name, f.Ext, extentNum, b, totalBlocks)
+					outOfRange = append(outOfRange, int(b))
+					extBytes.Write(make([]byte, blockSize))
+					continue
+				}
+				if isDirBlock(d.dirAL, int(b)) {
+					fmt.Fprintf(stderr, "Warning: %s.%s lists directory block %d; writing zeros in its place\n", f.Name, f.Ext, b)
+					extBytes.Write(make([]byte, blockSize))
+					continue
+				}
 				blocks = append(blocks, int(b))
 				chunk, err := getBlock(d, int(b))
-				if err != nil { fmt.Fprintf(os.Stderr, "Block read err for %s.%s: %v\n", f.Name, f.Ext, err); break }
+				if err != nil {
+					fmt.Fprintf(stderr, "Block read err for %s.%s: %v; writing zeros at offset %d\n", f.Name, f.Ext, err, assembled.Len()+extBytes.Len())
+					unreadable = append(unreadable, int(b))
+					chunk = make([]byte, blockSize)
+				}
 				extBytes.Write(chunk)
 			}
 			// respect RC (records of 128 bytes)
-			want := int(e.RC) * 128
+			want := e.size(layoutOf(d).extentMask())
+			overRC := want > extBytes.Len()
+			missing := want > 0
+			for _, b := range e.Blocks { if b != 0 { missing = false } }
+			if missing {
+				fmt.Fprintf(stderr, "Warning: %s.%s extent %d has RC %d but lists no blocks; its %d bytes are missing and the file is incomplete\n",
+					f.Name, f.Ext, extentNum, e.RC, want)
+			} else if overRC {
+				fmt.Fprintf(stderr, "Warning: %s.%s extent %d has RC %d (%d bytes) but its %d block(s) hold only %d; directory may be corrupt\n",
+					f.Name, f.Ext, extentNum, e.RC, want, extBytes.Len()/blockSize, extBytes.Len())
+			}
 			if want > extBytes.Len() { want = extBytes.Len() }
 			assembled.Write(extBytes.Bytes()[:want])
 
@@ -345,15 +1206,27 @@ func main() {
 				Extent: extentNum,
 				RC: int(e.RC),
 				Blocks: blocks,
+				RCExceedsBlocks: overRC,
+				OutOfRange: outOfRange,
+				Unreadable: unreadable,
+				MissingBlocks: missing,
 			})
 		}
 		fileBytes := assembled.Bytes()
+		if o.physical {
+			b, err := readPhysical(d, extentMetas, f.TotalBytes)
+			if err != nil { fmt.Fprintf(stderr, "Block read err for %s.%s: %v\n", f.Name, f.Ext, err) }
+			fileBytes = b
+		}
 
 		// Prepare names
 		base := strings.TrimRight(f.Name, " ")
 		ext  := strings.TrimRight(f.Ext, " ")
 		if base == "" { base = "NONAME" }
 		saveName := fmt.Sprintf("%s.%s", base, ext)
+		if ext == "" && !o.dot { saveName = base }
+		if o.lower { saveName = strings.ToLower(saveName) }
+		if o.order == "slot" { saveName = fmt.Sprintf("%03d_%s", f.FirstSlot, saveName) }
 		savePath := filepath.Join(outdir, saveName)
 
 		// Detect +3 header and optionally strip
@@ -362,29 +1235,86 @@ func main() {
 		var hadHeader bool
 		if data, hdr, ok := peelPlus3Header(fileBytes); ok {
 			plus3, hadHeader = hdr, true
-			if !*flagKeep {
+			if !hdr.TotalLenOK {
+				fmt.Fprintf(stderr, "Warning: %s.%s +3DOS header total length %d is implausible (file has %d bytes, data length %d)\n",
+					f.Name, f.Ext, hdr.TotalLength, len(fileBytes), hdr.DataLength)
+			}
+			if hdr.Basic != nil && !hdr.Basic.OK {
+				fmt.Fprintf(stderr, "Warning: %s.%s BASIC program does not match its header: %s\n", f.Name, f.Ext, hdr.Basic.Problem)
+			}
+			if !hdr.IssueVerOK {
+				fmt.Fprintf(stderr, "Warning: %s.%s +3DOS header has issue %d, version %d (expected 1, 0); header may be foreign or corrupt\n",
+					f.Name, f.Ext, hdr.Issue, hdr.Version)
+			}
+			if !o.keepHeader {
 				outData = data
+			} else {
+				outData = fileBytes[:128+len(data)] // header plus exactly DataLength, no record padding
 			}
 		}
 
+		if o.text && !hadHeader {
+			if t, ok := trimText(outData); ok { outData = t }
+		}
+
+		if o.pad > len(outData) {
+			outData = append(append([]byte(nil), outData...), bytes.Repeat([]byte{byte(o.padByte)}, o.pad-len(outData))...)
+		}
+
+		meta := FileMeta{
+			User: int(f.User), Name: base, Ext: ext,
+			ReadOnly: f.Attr&attrReadOnly != 0,
+			System: f.Attr&attrSystem != 0,
+			Archive: f.Attr&attrArchive != 0,
+			TotalBytes: f.TotalBytes,
+			Extents: extentMetas,
+			Plus3: plus3,
+			OutputName: saveName,
+			OutputSize: len(outData),
+			HeaderKept: o.keepHeader && hadHeader,
+			Conflicts: f.Conflicts,
+			Physical: o.physical,
+		}
+		if manifest {
+			meta.CRC32 = fmt.Sprintf("%08x", crc32.ChecksumIEEE(outData))
+			man.Files = append(man.Files, meta)
+			written++
+			continue
+		}
+
 		// Write file
 		if err := os.WriteFile(savePath, outData, 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "Write error %s: %v\n", saveName, err)
+			fmt.Fprintf(stderr, "Write error %s: %v\n", saveName, err)
 			continue
 		}
-		fmt.Printf("Extracted %s (%d bytes)\n", saveName, len(outData))
+		written++
+		if o.crc {
+			meta.CRC32 = fmt.Sprintf("%08x", crc32.ChecksumIEEE(outData))
+			fmt.Fprintf(stdout, "Extracted %s (%d bytes) crc32=%s\n", saveName, len(outData), meta.CRC32)
+		} else {
+			fmt.Fprintf(stdout, "Extracted %s (%d bytes)\n", saveName, len(outData))
+		}
+		if plus3 != nil && plus3.Type == 3 {
+			kind := "CODE"
+			if plus3.CodeKind == "screen" { kind = "SCREEN$" }
+			fmt.Fprintf(stdout, "  %s, load address %d (0x%04X)\n", kind, plus3.LoadAddress, plus3.LoadAddress)
+		}
 
-		// Write metadata JSON when requested
-		if *flagMeta {
-			meta := FileMeta{
-				User: int(f.User), Name: base, Ext: ext,
-				TotalBytes: f.TotalBytes,
-				Extents: extentMetas,
-				Plus3: plus3,
-				OutputName: saveName,
-				OutputSize: len(outData),
-				HeaderKept: *flagKeep && hadHeader,
+		// Write the exact header bytes when requested
+		if o.hdr && hadHeader {
+			if err := os.WriteFile(savePath+".hdr", fileBytes[:128], 0644); err != nil {
+				fmt.Fprintf(stderr, "Write error %s.hdr: %v\n", saveName, err)
 			}
+		}
+
+		if o.split && hadHeader {
+			if err := os.WriteFile(savePath+".p3h", fileBytes[:128], 0644); err != nil {
+				fmt.Fprintf(stderr, "Write error %s.p3h: %v\n", saveName, err)
+			}
+		}
+
+		// Write metadata JSON when requested
+		if o.meta {
 			js, err := json.MarshalIndent(meta, "", "  ")
 			if err == nil {
 				jsonPath := savePath + ".json"
@@ -392,4 +1322,84 @@ func main() {
 			}
 		}
 	}
+	return nil
+}
+
+func main() {
+	flagKeep := flag.Bool("keepheader", false, "keep +3DOS 128-byte headers (default: strip if present)")
+	flagMeta := flag.Bool("meta", false, "write a .json metadata file alongside each extracted file")
+	flagSchema := flag.Bool("json-schema", false, "print the JSON Schema describing the -meta output and exit")
+	flagDoubleStep := flag.Bool("doublestep", false, "read every other track (40-track disk stored in an 80-track image); auto-detected when possible")
+	flagPhysical := flag.Bool("physical", false, "DEBUG: assemble each file from its blocks in ascending block-number order instead of logical extent order")
+	flagCRC := flag.Bool("crc", false, "print the CRC32 of each extracted file (stored in the metadata with -meta)")
+	flagMaxSize := flag.Int("max-file-size", 0, "skip any file whose directory entries add up to more than this many bytes, guarding against cross-linked extents (0 = the disk's data area)")
+	flagPad := flag.Int("pad", 0, "right-pad every extracted file to at least N bytes")
+	flagPadByte := flag.Int("pad-byte", 0, "fill byte used by -pad")
+	flagHdr := flag.Bool("hdr", false, "write the raw 128-byte +3DOS header of each headed file to a .hdr sidecar")
+	flagSplit := flag.Bool("split-header", false, "write each headed file as its body (NAME.EXT) and its 128-byte header (NAME.EXT.p3h), overriding -keepheader")
+	flagText := flag.Bool("text", false, "cut headerless files that look like text at the ^Z (0x1A) that ends them, dropping the CP/M record padding")
+	flagGeometry := flag.String("geometry", "", "force the layout as TRACKSxSIDESxSECTORSxSECSIZExRESERVEDxBLOCK[xDIRBLOCKS] (e.g. 40x1x9x512x1x1024), skipping all detection")
+	flagLimit := flag.Int("limit", 0, "stop after extracting N files (0 = no limit)")
+	flagManifest := flag.String("manifest-only", "", "reassemble every file but write only a combined JSON manifest to this file: -manifest-only <out.json> <image.dsk>")
+	flagOrder := flag.String("order", "name", "extraction order: name (by user, name, extension) or slot (directory order, output names prefixed with the slot number)")
+	flagFree := flag.String("freespace", "", "write the raw bytes of every unallocated block, in block order, to this file (the <outdir> may then be omitted)")
+	flagMatch := flag.String("match", "", "extract only files whose NAME.EXT matches a CP/M wildcard such as \"*.BAS\" or \"GAME?.*\"")
+	flagFile := flag.String("file", "", "extract only NAME.EXT (case-insensitive); it is an error if the disk has no such file")
+	flagUser := flag.Int("user", -1, "extract only files in CP/M user area N (0..15); -1 extracts every user area")
+	flagLower := flag.Bool("lowercase", false, "lowercase output filenames (name and extension); the metadata keeps the CP/M spelling")
+	flagDot := flag.Bool("keep-trailing-dot", true, "name files without an extension NAME. (the default); -keep-trailing-dot=false writes NAME")
+	flagNoDot := flag.Bool("no-dot", false, "same as -keep-trailing-dot=false")
+	flagBatch := flag.Bool("batchdir", false, "extract every .dsk below a directory, each into the folder of the same relative path under <outdir>, GOMAXPROCS images at a time: -batchdir <dir> <outdir>")
+	flag.Parse()
+	if *flagSchema {
+		js, _ := json.MarshalIndent(metaSchema(), "", "  ")
+		fmt.Println(string(js))
+		return
+	}
+	manifest := *flagManifest != ""
+	if !*flagBatch && flag.NArg() != 2 && !((*flagFree != "" || manifest) && flag.NArg() == 1) {
+		fmt.Fprintf(os.Stderr, "Usage: %s <image.dsk> <outdir> [-user N] [-file NAME.EXT] [-match PATTERN] [-keepheader] [-meta] [-hdr] [-doublestep]\n       %s -freespace <free.bin> <image.dsk> [<outdir>]\n       %s -manifest-only <out.json> <image.dsk>\n       %s -batchdir <dir> <outdir>\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		os.Exit(2)
+	}
+	if *flagOrder != "name" && *flagOrder != "slot" {
+		fmt.Fprintf(os.Stderr, "unknown -order %q (want name|slot)\n", *flagOrder)
+		os.Exit(2)
+	}
+	if *flagUser < -1 || *flagUser > 15 {
+		fmt.Fprintf(os.Stderr, "-user %d out of range 0..15\n", *flagUser)
+		os.Exit(2)
+	}
+	o := &options{
+		keepHeader: *flagKeep && !*flagSplit, meta: *flagMeta, doubleStep: *flagDoubleStep, physical: *flagPhysical,
+		crc: *flagCRC, hdr: *flagHdr, split: *flagSplit, text: *flagText, lower: *flagLower, dot: *flagDot && !*flagNoDot,
+		maxSize: *flagMaxSize, pad: *flagPad, padByte: *flagPadByte, limit: *flagLimit, user: *flagUser,
+		manifest: *flagManifest, order: *flagOrder, free: *flagFree, match: *flagMatch, file: *flagFile,
+		geometrySpec: *flagGeometry,
+	}
+	if *flagKeep && *flagSplit {
+		fmt.Fprintf(os.Stderr, "Warning: -split-header writes headers to .p3h files; -keepheader is ignored\n")
+	}
+	if *flagGeometry != "" {
+		g, err := parseGeometry(*flagGeometry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-geometry: %v\n", err)
+			os.Exit(2)
+		}
+		o.geometry = g
+	}
+	if *flagBatch {
+		if flag.NArg() != 2 || *flagFree != "" || manifest {
+			fmt.Fprintf(os.Stderr, "Usage: %s -batchdir [flags] <dir> <outdir> (not with -freespace or -manifest-only, which name one output file)\n", os.Args[0])
+			os.Exit(2)
+		}
+		os.Exit(batchExtract(flag.Arg(0), flag.Arg(1), o))
+	}
+	if manifest && flag.Arg(1) != "" {
+		fmt.Fprintf(os.Stderr, "-manifest-only writes no files; drop the <outdir> argument\n")
+		os.Exit(2)
+	}
+	if err := extractImage(flag.Arg(0), flag.Arg(1), o, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
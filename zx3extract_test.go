@@ -0,0 +1,430 @@
+package main
+
+// Each tool is its own main package, so the tests are run one tool at a time:
+//
+//	go test zx3extract.go zx3extract_test.go wildmatch83_test.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// buildTool compiles another of the repo's tools, e.g. "zx3dsk", into a temporary
+// directory and returns the path of the binary.
+func buildTool(t *testing.T, name string) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), name)
+	if out, err := exec.Command("go", "build", "-o", bin, name+".go").CombinedOutput(); err != nil {
+		t.Fatalf("go build %s.go: %v\n%s", name, err, out)
+	}
+	return bin
+}
+
+// makeImage writes files to a folder and builds an image of it with zx3dsk, passing
+// args before the folder and image names.
+func makeImage(t *testing.T, files map[string][]byte, args ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(t.TempDir(), "test.dsk")
+	args = append(args, dir, image)
+	if out, err := exec.Command(buildTool(t, "zx3dsk"), args...).CombinedOutput(); err != nil {
+		t.Fatalf("zx3dsk %v: %v\n%s", args, err, out)
+	}
+	return image
+}
+
+// writtenDirSectors finds the directory sectors of an image zx3dsk wrote with a full
+// directory of files F000.BIN, F001.BIN, ...: by the entries they hold, not by working
+// out the layout, in the order of the files they list.
+func writtenDirSectors(d *disk) []secLoc {
+	found := map[int]secLoc{}
+	for rec, trk := range d.Tracks {
+		for _, s := range trk.Sectors {
+			if len(s.Data) < 32 || !bytes.HasPrefix(s.Data, []byte{0, 'F'}) || string(s.Data[5:12]) != "    BIN" {
+				continue
+			}
+			if i, err := strconv.Atoi(string(s.Data[2:5])); err == nil {
+				found[i/(len(s.Data)/32)] = secLoc{rec, s.R}
+			}
+		}
+	}
+	var locs []secLoc
+	for k := 0; ; k++ {
+		loc, ok := found[k]
+		if !ok {
+			return locs
+		}
+		locs = append(locs, loc)
+	}
+}
+
+func TestDirectoryAgreesWithWriter(t *testing.T) {
+	for _, format := range []string{"180k", "720k"} {
+		// Fill every directory entry, so a reader that stops short loses files. The
+		// spec zx3dsk writes on a blank disk says how many there are.
+		blank, err := parseDSK(makeImage(t, nil, "-format", format), os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec := specT0S1(blank)
+		n := int(spec[7]) * (128 << spec[6]) / 32
+		files := map[string][]byte{}
+		for i := 0; i < n; i++ {
+			files[fmt.Sprintf("f%03d.bin", i)] = []byte{byte(i)}
+		}
+		image := makeImage(t, files, "-format", format, "-noheader", "*")
+		d, err := parseDSK(image, os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := layoutOf(d)
+		want := writtenDirSectors(d)
+		if len(want)*512 != n*32 {
+			t.Fatalf("%s: found %d directory sector(s) in the image for %d entries", format, len(want), n)
+		}
+		if got := dirLocations(l, dirAllocation(l.dirBlocks)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: directory sectors %v, want %v", format, got, want)
+		}
+		secs, err := dirSectors(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(aggregate(parseDir(secs, l.wide()), l.extentMask())); got != n {
+			t.Errorf("%s: directory holds %d file(s), want %d", format, got, n)
+		}
+	}
+}
+
+func TestUserAreaRoundTrip(t *testing.T) {
+	image := makeImage(t, map[string][]byte{"game.bin": []byte("game")}, "-user", "7")
+	d, err := parseDSK(image, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secs, err := dirSectors(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := parseDir(secs, layoutOf(d).wide())
+	if len(entries) != 1 || entries[0].User != 7 || entries[0].Name != "GAME" || entries[0].Ext != "BIN" {
+		t.Errorf("directory holds %+v, want GAME.BIN in user 7", entries)
+	}
+}
+
+// renameSector gives sector from on track record rec of an EDSK image the ID to.
+// Track-Info blocks follow the 256-byte Disk-Info block, sized in 256-byte units by its
+// table at 0x34; sector R is byte 2 of each 8-byte entry of the Track-Info sector list.
+func renameSector(t *testing.T, image string, rec int, from, to byte) {
+	t.Helper()
+	raw, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := 256
+	for tr := 0; tr < rec; tr++ {
+		off += int(raw[0x34+tr]) * 256
+	}
+	for i := 0; i < int(raw[off+0x15]); i++ {
+		if r := off + 0x18 + 8*i + 2; raw[r] == from {
+			raw[r] = to
+		}
+	}
+	if err := os.WriteFile(image, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenamedSectorIsMissing(t *testing.T) {
+	data := make([]byte, 20*1024)
+	for i := range data {
+		data[i] = byte(i / 512) // every sector different, so a shifted read shows
+	}
+	image := makeImage(t, map[string][]byte{"big.bin": data}, "-noheader", "*")
+	want, err := parseDSK(image, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameSector(t, image, 3, 1, 0x20)
+	d, err := parseDSK(image, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := layoutOf(d)
+	for b := 0; b < l.dataBlocks(); b++ {
+		rec, r := l.locate(b * l.blockSectors())
+		got, err := getBlock(d, b)
+		if rec == 3 && r == 1 {
+			if err == nil || err.Error() != "missing sector T3 R1" {
+				t.Errorf("block %d: error %v, want missing sector T3 R1", b, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("block %d: %v", b, err)
+			continue
+		}
+		if w, _ := getBlock(want, b); !bytes.Equal(got, w) {
+			t.Errorf("block %d reads different data once T3 R1 is renamed", b)
+		}
+	}
+}
+
+func TestSkippedBlocksKeepOffsets(t *testing.T) {
+	data := make([]byte, 20*1024)
+	for i := range data {
+		data[i] = byte(i/512) + 1
+	}
+	image := makeImage(t, map[string][]byte{"big.bin": data}, "-noheader", "*")
+	// Make block 9 (T3 R1-R2) unreadable and point the entry's second block past the
+	// data area: both must come out as a block of zeros, not close the gap.
+	renameSector(t, image, 3, 1, 0x20)
+	raw, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := bytes.Index(raw, []byte("\x00BIG     BIN\x00"))
+	if entry < 0 {
+		t.Fatal("no directory entry for BIG.BIN")
+	}
+	raw[entry+17] = 0xFF
+	if err := os.WriteFile(image, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	log, err := exec.Command(buildTool(t, "zx3extract"), image, out).CombinedOutput()
+	if err != nil {
+		t.Fatalf("zx3extract: %v\n%s", err, log)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "BIG.BIN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte(nil), data...)
+	for _, b := range []int{1, 7} { // the file lists blocks 2, 3, ...: block 3 is now 0xFF, and block 9 is eighth
+		copy(want[b*1024:(b+1)*1024], make([]byte, 1024))
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("BIG.BIN is %d bytes and differs from the original with two zeroed blocks\n%s", len(got), log)
+	}
+}
+
+func TestTrimText(t *testing.T) {
+	record := func(text string, fill byte) []byte {
+		b := bytes.Repeat([]byte{fill}, 128)
+		copy(b, text)
+		return b
+	}
+	text := []byte("10 PRINT \"HELLO\"\r\n")
+	binary := make([]byte, 128)
+	for i := range binary {
+		binary[i] = byte(0x80 + i) // no ^Z among them
+	}
+	tests := []struct {
+		name string
+		file []byte
+		want []byte // nil: left as it is
+	}{
+		{"padded text", record(string(text), 0x1A), text},
+		{"text then a padded record", append(record("more text", 'x'), record(string(text), 0x1A)...), append(record("more text", 'x'), text...)},
+		{"^Z not followed by padding", record(string(text)+"\x1Atext", 0x1A), nil},
+		{"text before ^Z, binary after", append(record(string(text), 0x1A), binary...), nil},
+		{"binary before ^Z", record(string(binary[:100]), 0x1A), nil},
+		{"no ^Z", []byte("plain text"), nil},
+	}
+	for _, tt := range tests {
+		got, ok := trimText(tt.file)
+		if ok != (tt.want != nil) || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: trimText = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestBatchExtract(t *testing.T) {
+	root := t.TempDir()
+	a := makeImage(t, map[string][]byte{"a.txt": []byte("a")})
+	b := makeImage(t, map[string][]byte{"b.txt": []byte("b")}, "-user", "2")
+	for src, dst := range map[string]string{a: "a.dsk", b: filepath.Join("sub", "b.dsk")} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, dst)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dst), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "bad.dsk"), []byte("not a disk image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	log, err := exec.Command(buildTool(t, "zx3extract"), "-batchdir", "-user", "2", root, out).CombinedOutput()
+	if err == nil {
+		t.Errorf("zx3extract -batchdir succeeded with a bad image\n%s", log)
+	}
+	if !bytes.Contains(log, []byte("Extracted 2 of 3 image(s)")) || !bytes.Contains(log, []byte("bad.dsk: Parse error:")) {
+		t.Errorf("summary does not report 2 of 3 images extracted and bad.dsk failed:\n%s", log)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "sub", "b", "B.TXT")); err != nil || string(got) != "b" {
+		t.Errorf("sub/b.dsk: B.TXT holds %q (%v), want %q", got, err, "b")
+	}
+	if _, err := os.Stat(filepath.Join(out, "a", "A.TXT")); err == nil {
+		t.Errorf("a.dsk: A.TXT in user 0 extracted despite -user 2")
+	}
+}
+
+// checkSchema reports where v, a decoded JSON value, breaks the schema node s: a wrong
+// type, a missing required property, a property the schema does not describe, or an
+// integer outside its bounds. defs resolves "$ref"s.
+func checkSchema(t *testing.T, s, defs map[string]any, v any, at string) {
+	t.Helper()
+	if ref, ok := s["$ref"].(string); ok {
+		s = defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]any)
+	}
+	kind := map[bool]string{true: "null"}[v == nil]
+	switch v := v.(type) {
+	case bool:
+		kind = "boolean"
+	case string:
+		kind = "string"
+	case float64:
+		kind = "number"
+		if v == float64(int64(v)) {
+			kind = "integer"
+		}
+		if lo, ok := s["minimum"].(float64); ok && v < lo {
+			t.Errorf("%s: %v below the minimum %v", at, v, lo)
+		}
+		if hi, ok := s["maximum"].(float64); ok && v > hi {
+			t.Errorf("%s: %v above the maximum %v", at, v, hi)
+		}
+	case []any:
+		kind = "array"
+		for i, x := range v {
+			checkSchema(t, s["items"].(map[string]any), defs, x, fmt.Sprintf("%s[%d]", at, i))
+		}
+	case map[string]any:
+		kind = "object"
+		props, _ := s["properties"].(map[string]any)
+		for name, x := range v {
+			p, ok := props[name].(map[string]any)
+			if !ok {
+				t.Errorf("%s: property %q is not in the schema", at, name)
+				continue
+			}
+			checkSchema(t, p, defs, x, at+"."+name)
+		}
+		req, _ := s["required"].([]any)
+		for _, name := range req {
+			if _, ok := v[name.(string)]; !ok {
+				t.Errorf("%s: required property %q missing", at, name)
+			}
+		}
+	}
+	var types []any
+	switch ty := s["type"].(type) {
+	case string:
+		types = []any{ty}
+	case []any:
+		types = ty
+	}
+	for _, ty := range types {
+		if ty == kind || (ty == "number" && kind == "integer") {
+			return
+		}
+	}
+	if len(types) > 0 {
+		t.Errorf("%s: %s where the schema wants %v", at, kind, types)
+	}
+}
+
+// fillValue sets every field reachable from v to a value that is not zero, so that
+// omitempty fields marshal too.
+func fillValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			fillValue(v.Field(i))
+		}
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0))
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	}
+}
+
+func TestMetaMatchesSchema(t *testing.T) {
+	js, err := json.Marshal(metaSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(js, &schema); err != nil {
+		t.Fatal(err)
+	}
+	defs := schema["$defs"].(map[string]any)
+	check := func(name string, b []byte) {
+		var v any
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkSchema(t, schema, defs, v, name)
+	}
+
+	var full, empty FileMeta
+	fillValue(reflect.ValueOf(&full).Elem())
+	for name, m := range map[string]FileMeta{"every field set": full, "zero value": empty} {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(name, b)
+	}
+
+	// And what zx3extract -meta actually writes.
+	image := makeImage(t, map[string][]byte{
+		"loader.bas": {0, 10, 2, 0, 0xF9, 0x0D},
+		"big.bin":    bytes.Repeat([]byte{0xAA}, 40000),
+		"notes":      []byte("text\n"),
+	}, "-noheader", "notes")
+	out := t.TempDir()
+	if b, err := exec.Command(buildTool(t, "zx3extract"), "-meta", "-crc", image, out).CombinedOutput(); err != nil {
+		t.Fatalf("zx3extract: %v\n%s", err, b)
+	}
+	metas, _ := filepath.Glob(filepath.Join(out, "*.json"))
+	if len(metas) != 3 {
+		t.Fatalf("zx3extract -meta wrote %d metadata file(s), want 3", len(metas))
+	}
+	for _, path := range metas {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(filepath.Base(path), b)
+	}
+}
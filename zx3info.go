@@ -8,17 +8,27 @@ package main
 // - Uses the track size table to decide whether a track exists; if size==0, skip reading it.
 // - For each existing track, reads one 256-byte "Track-Info\r\n" header, then N sector entries.
 // - For each sector, uses the 16-bit data length when present; otherwise falls back to 128<<N.
-// - For +3 directory listing: require +3 spec at T0,S1 and 512B sectors for T1 S1..S4.
+// - For +3 directory listing: require +3 spec at T0,S1; it gives the layout of the data area.
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type diskType int
@@ -34,22 +44,49 @@ type secHeader struct {
 	DataLen              uint16
 }
 type sector struct {
-	R    int
-	Data []byte
+	R        int
+	N        byte
+	ST1, ST2 byte // FDC status flags from the Track-Info sector list
+	Data     []byte
 }
 type track struct {
-	Sectors []sector
-	ByID    map[int]*sector
+	Sectors   []sector
+	ByID      map[int]*sector
+	Cyl, Head byte // as recorded in the Track-Info block
+	Side      int  // side the record sits on in the image: record index % sides
+	// Track-Info fields; DataRate and RecMode are 0 (unknown) in older images.
+	DataRate, RecMode, Gap3, Filler byte
+	// Pad holds the bytes between the last sector's data and the next Track-Info.
+	Pad []byte
 }
 type disk struct {
 	kind      diskType
 	tracks    int
 	sides     int
 	trackSize []int
-	Tracks    []track // cylinder index -> track
+	creator   string  // Disk-Info 0x22..0x2F, the tool that wrote the image
+	Tracks    []track // track record index (cylinder*sides + side) -> track
+	dirAL     uint16  // AL0/AL1 directory bitmap, set by dirSectors
+	assumed   []byte  // the spec -assume-plus3 reads the disk by when T0,S1 holds no valid one
+	// idBase is the sector ID the tracks number from and idSpan how many IDs a full
+	// track runs to, both settled once for the disk by settleIDs.
+	idBase, idSpan int
 }
 
 // --- helpers ---
+
+// creatorString turns the 14-byte creator field of the Disk-Info block into text: NUL
+// and space padding is trimmed and any other unprintable byte shows as '.'.
+func creatorString(b []byte) string {
+	out := []byte(strings.TrimRight(string(b), "\x00 "))
+	for i, c := range out {
+		if c < 0x20 || c > 0x7E {
+			out[i] = '.'
+		}
+	}
+	return string(out)
+}
+
 func readExactly(r io.Reader, n int) ([]byte, error) {
 	buf := make([]byte, n)
 	_, err := io.ReadFull(r, buf)
@@ -57,15 +94,90 @@ func readExactly(r io.Reader, n int) ([]byte, error) {
 }
 
 // --- parser ---
-func parseDSK(path string) (*disk, error) {
+
+// dskMagics are the Disk-Info signatures of standard and extended DSK images.
+var dskMagics = [][]byte{
+	[]byte("EXTENDED CPC DSK File\r\nDisk-Info\r\n"),
+	[]byte("MV - CPCEMU Disk-File\r\nDisk-Info\r\n"),
+}
+
+// skipJunk positions f at the start of the DSK header. Stray bytes (download
+// artifacts) sometimes precede it, so the first 4KB are searched for a signature;
+// when it is not at offset 0 a warning says how many bytes were skipped.
+func skipJunk(f *os.File, path string) error {
+	buf := make([]byte, 4096)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	off := -1
+	for _, m := range dskMagics {
+		if i := bytes.Index(buf[:n], m); i >= 0 && (off < 0 || i < off) {
+			off = i
+		}
+	}
+	if off > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s: skipping %d junk byte(s) before the DSK header\n", path, off)
+	} else {
+		off = 0
+	}
+	_, err = f.Seek(int64(off), io.SeekStart)
+	return err
+}
+
+// nextTrack skips to the next track's Track-Info: size bytes into this one unless the
+// Disk-Info table is off, in which case it resynchronises on the magic with a warning.
+func nextTrack(f *os.File, path string, t, size, read int) error {
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	magic := []byte("Track-Info\r\n")
+	if pad := size - read; pad >= 0 {
+		probe := make([]byte, len(magic))
+		if n, _ := f.ReadAt(probe, end+int64(pad)); n < len(magic) || bytes.Equal(probe, magic) {
+			_, err = f.Seek(end+int64(pad), io.SeekStart) // as the table says, or the last track
+			return err
+		}
+	}
+	buf := make([]byte, 0x10000)
+	n, _ := f.ReadAt(buf, end)
+	i := bytes.Index(buf[:n], magic)
+	if i < 0 {
+		if read > size {
+			fmt.Fprintf(os.Stderr, "Warning: %s: track %d holds %d bytes, more than the %d in the Disk-Info table\n", path, t, read, size)
+		}
+		_, err = f.Seek(end, io.SeekStart) // trust the bytes actually read
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %s: track %d is %d bytes in the Disk-Info table but the next Track-Info starts after %d; resynchronised there\n",
+		path, t, size, read+i)
+	_, err = f.Seek(end+int64(i), io.SeekStart)
+	return err
+}
+
+// parseDSK reads an image. When fullTracks >= 0 only the sector data of the first
+// fullTracks tracks (spec and directory) is loaded; the data of every later track
+// is seeked past and left nil, which makes cataloging large archives much faster.
+// Each track is found through nextTrack, so a wrong Disk-Info size table costs a
+// warning rather than the rest of the image.
+func parseDSK(path string, fullTracks int) (*disk, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
+	if err := skipJunk(f, path); err != nil {
+		return nil, err
+	}
 
-	hdr, err := readExactly(f, 256)
-	if err != nil {
+	// The Disk-Info block is 256 bytes, but only 0x00..0x33 (plus the extended size
+	// table) carry data. Accept a file that ends inside the block as a minimal image
+	// with no track data instead of rejecting it outright.
+	hdr := make([]byte, 256)
+	hdrLen, err := io.ReadFull(f, hdr)
+	short := errors.Is(err, io.ErrUnexpectedEOF) && hdrLen >= 0x34
+	if err != nil && !short {
 		return nil, err
 	}
 
@@ -89,7 +201,7 @@ func parseDSK(path string) (*disk, error) {
 	total := tracks * sides
 	ts := make([]int, total)
 	if kind == dskExtended {
-		if 0x34+total > 256 {
+		if 0x34+total > 256 || (short && 0x34+total > hdrLen) {
 			return nil, errors.New("invalid track size table")
 		}
 		for i := 0; i < total; i++ {
@@ -105,7 +217,11 @@ func parseDSK(path string) (*disk, error) {
 		}
 	}
 
-	d := &disk{kind: kind, tracks: tracks, sides: sides, trackSize: ts, Tracks: make([]track, tracks)}
+	d := &disk{kind: kind, tracks: tracks, sides: sides, trackSize: ts, creator: creatorString(hdr[0x22:0x30]), Tracks: make([]track, total)}
+	if short {
+		settleIDs(d)
+		return d, nil // header-only image: every track unformatted
+	}
 
 	// Read tracks one by one using sizes
 	for t := 0; t < total; t++ {
@@ -135,7 +251,11 @@ func parseDSK(path string) (*disk, error) {
 			}
 			off += 8
 		}
-		trk := track{Sectors: make([]sector, secCount), ByID: map[int]*sector{}}
+		trk := track{
+			Sectors: make([]sector, secCount), ByID: map[int]*sector{},
+			Cyl: th[0x10], Head: th[0x11],
+			DataRate: th[0x12], RecMode: th[0x13], Gap3: th[0x16], Filler: th[0x17],
+		}
 		read := 256
 		for i := 0; i < secCount; i++ {
 			want := int(headers[i].DataLen)
@@ -145,171 +265,2049 @@ func parseDSK(path string) (*disk, error) {
 			if want < 0 {
 				return nil, fmt.Errorf("track %d sector %d: bad length", t, i+1)
 			}
-			payload, err := readExactly(f, want)
+			var payload []byte
+			if fullTracks >= 0 && t >= fullTracks {
+				_, err = f.Seek(int64(want), io.SeekCurrent)
+			} else {
+				payload, err = readExactly(f, want)
+			}
 			if err != nil {
 				return nil, fmt.Errorf("track %d: %w", t, err)
 			}
 			read += want
-			trk.Sectors[i] = sector{R: int(headers[i].R), Data: payload}
+			trk.Sectors[i] = sector{R: int(headers[i].R), N: headers[i].N, ST1: headers[i].ST1, ST2: headers[i].ST2, Data: payload}
 			trk.ByID[int(headers[i].R)] = &trk.Sectors[i]
 		}
-		// Skip padding to declared track size
-		pad := size - read
-		if pad > 0 {
-			_, _ = readExactly(f, pad)
+		end, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %w", t, err)
+		}
+		if err := nextTrack(f, path, t, size, read); err != nil {
+			return nil, fmt.Errorf("track %d: %w", t, err)
 		}
-		// Map t back to cylinder (SS: t==cyl)
-		cyl := t
-		if cyl < len(d.Tracks) {
-			d.Tracks[cyl] = trk
+		if next, _ := f.Seek(0, io.SeekCurrent); next > end && !(fullTracks >= 0 && t >= fullTracks) {
+			trk.Pad = make([]byte, next-end)
+			n, _ := f.ReadAt(trk.Pad, end)
+			trk.Pad = trk.Pad[:n] // the last track may be cut short
 		}
+		// Records run cyl0/side0, cyl0/side1, cyl1/side0, ...; single-sided: t == cyl
+		trk.Side = t % sides
+		d.Tracks[t] = trk
 	}
-
+	settleIDs(d)
 	return d, nil
 }
 
+// trackLabel names track record t: the cylinder on a single-sided image, cylinder/side
+// on a double-sided one.
+func (d *disk) trackLabel(t int) string {
+	if d.sides == 1 {
+		return fmt.Sprint(t)
+	}
+	return fmt.Sprintf("%d/%d", t/d.sides, t%d.sides)
+}
+
+// --- Track-Info field names ---
+func dataRateName(b byte) string {
+	switch b {
+	case 0:
+		return "unknown"
+	case 1:
+		return "SD/DD"
+	case 2:
+		return "HD"
+	case 3:
+		return "ED"
+	}
+	return fmt.Sprintf("0x%02X", b)
+}
+
+func recModeName(b byte) string {
+	switch b {
+	case 0:
+		return "unknown"
+	case 1:
+		return "FM"
+	case 2:
+		return "MFM"
+	}
+	return fmt.Sprintf("0x%02X", b)
+}
+
+func printTracks(d *disk) {
+	fmt.Println("\nTracks:")
+	fmt.Println(" Track  Sectors  Rate     Mode     GAP3  Filler")
+	for t, trk := range d.Tracks {
+		if len(trk.Sectors) == 0 {
+			fmt.Printf("  %4s  (unformatted)\n", d.trackLabel(t))
+			continue
+		}
+		fmt.Printf("  %4s  %7d  %-7s  %-7s  0x%02X  0x%02X\n", d.trackLabel(t), len(trk.Sectors),
+			dataRateName(trk.DataRate), recModeName(trk.RecMode), trk.Gap3, trk.Filler)
+	}
+}
+
+// listTracks prints one line per track: geometry as recorded in the Track-Info block,
+// the sector sizes present and whether any sector carries ST1/ST2 flags.
+func listTracks(d *disk) {
+	fmt.Println("\nTrack geometry:")
+	fmt.Println(" Track  Cyl  Head  Sectors  Sizes       Flags")
+	for t, trk := range d.Tracks {
+		if len(trk.Sectors) == 0 {
+			fmt.Printf("  %4s  (unformatted)\n", d.trackLabel(t))
+			continue
+		}
+		var sizes []string
+		seen := map[int]bool{}
+		flagged := 0
+		for _, sec := range trk.Sectors {
+			n := len(sec.Data)
+			if sec.Data == nil {
+				n = 128 << sec.N // -info-only: data skipped
+			}
+			if !seen[n] {
+				seen[n] = true
+				sizes = append(sizes, fmt.Sprint(n))
+			}
+			if sec.ST1 != 0 || sec.ST2 != 0 {
+				flagged++
+			}
+		}
+		flags := "-"
+		if flagged > 0 {
+			flags = fmt.Sprintf("%d flagged", flagged)
+		}
+		fmt.Printf("  %4s  %3d  %4d  %7d  %-10s  %s\n", d.trackLabel(t), trk.Cyl, trk.Head, len(trk.Sectors), strings.Join(sizes, "/"), flags)
+	}
+}
+
+// FDC status bits as stored in the Track-Info sector list (uPD765 ST1/ST2).
+const (
+	st1MissingAM  = 0x01 // ST1 MA: no ID address mark
+	st1NoData     = 0x04 // ST1 ND: sector not found
+	st1DataError  = 0x20 // ST1 DE: CRC error
+	st2MissingDAM = 0x01 // ST2 MD: no data address mark
+	st2DataCRC    = 0x20 // ST2 DD: CRC error in the data field
+	st2Deleted    = 0x40 // ST2 CM: deleted data address mark
+)
+
+// sectorFlags names the status bits set on a sector. The deleted-data mark gets its own
+// label: it is deliberate (a protection or hiding trick), not a read error.
+func sectorFlags(st1, st2 byte) string {
+	var f []string
+	if st2&st2Deleted != 0 {
+		f = append(f, "DELETED-DATA")
+	}
+	if st1&st1DataError != 0 || st2&st2DataCRC != 0 {
+		f = append(f, "crc-error")
+	}
+	if st1&st1MissingAM != 0 || st2&st2MissingDAM != 0 {
+		f = append(f, "missing-am")
+	}
+	if st1&st1NoData != 0 {
+		f = append(f, "no-data")
+	}
+	if len(f) == 0 {
+		return "-"
+	}
+	return strings.Join(f, ",")
+}
+
+func printSectors(d *disk) {
+	fmt.Println("\nSectors:")
+	fmt.Println(" Track  R    Size  ST1   ST2   Flags")
+	for t, trk := range d.Tracks {
+		for _, sec := range trk.Sectors {
+			fmt.Printf("  %4s  %3d  %4d  0x%02X  0x%02X  %s\n", d.trackLabel(t), sec.R, len(sec.Data), sec.ST1, sec.ST2, sectorFlags(sec.ST1, sec.ST2))
+		}
+	}
+}
+
+// printGapData reports every track whose padding after the sector data holds anything
+// but filler (0x00, 0xE5, 0x4E or the track's own filler byte). Copy protections hide
+// data there, out of reach of the FDC's normal sector reads.
+func printGapData(d *disk) {
+	fmt.Println("\nGap data:")
+	found := 0
+	for t, trk := range d.Tracks {
+		odd, first := 0, -1
+		for i, b := range trk.Pad {
+			if b != 0x00 && b != 0xE5 && b != 0x4E && b != trk.Filler {
+				if first < 0 {
+					first = i
+				}
+				odd++
+			}
+		}
+		if odd == 0 {
+			continue
+		}
+		found++
+		show := trk.Pad[first:min(first+16, len(trk.Pad))]
+		fmt.Printf("  Track %s: %d of %d padding byte(s) are not filler, first at +%d: % X\n",
+			d.trackLabel(t), odd, len(trk.Pad), first, show)
+	}
+	if found == 0 {
+		fmt.Println("  none: every track's padding is filler")
+	}
+}
+
+// deletedSectors lists "T<track> R<id>" for every sector carrying a deleted-data mark.
+func deletedSectors(d *disk) []string {
+	var out []string
+	for t, trk := range d.Tracks {
+		for _, sec := range trk.Sectors {
+			if sec.ST2&st2Deleted != 0 {
+				out = append(out, fmt.Sprintf("T%s R%d", d.trackLabel(t), sec.R))
+			}
+		}
+	}
+	return out
+}
+
+// mixedSizeTracks lists the tracks whose sectors do not all share one size code (N).
+// Blocks are read as byte runs in sector ID order, which only holds if the sizes mix
+// the way the format expects.
+func mixedSizeTracks(d *disk) []string {
+	var out []string
+	for t, trk := range d.Tracks {
+		for _, sec := range trk.Sectors {
+			if sec.N != trk.Sectors[0].N {
+				out = append(out, d.trackLabel(t))
+				break
+			}
+		}
+	}
+	return out
+}
+
+// --- double-stepping ---
+
+// isDoubleStepped reports whether an image stores a 40-track disk on 80 physical
+// tracks: every odd track is either unformatted or a copy of the even track before it.
+// A +3 spec that claims more tracks than the halved count rules it out.
+func isDoubleStepped(d *disk) bool {
+	n := len(d.Tracks)
+	if d.sides != 1 || n < 80 || n%2 != 0 {
+		return false
+	}
+	if spec := specT0S1(d); looksPlus3Spec(spec) && int(spec[2]) > n/2 {
+		return false
+	}
+	for t := 1; t < n; t += 2 {
+		if len(d.Tracks[t].Sectors) != 0 && !sameTrack(d.Tracks[t], d.Tracks[t-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameTrack(a, b track) bool {
+	if len(a.Sectors) != len(b.Sectors) {
+		return false
+	}
+	for i := range a.Sectors {
+		if a.Sectors[i].R != b.Sectors[i].R || !bytes.Equal(a.Sectors[i].Data, b.Sectors[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+// doubleStep keeps every other physical track (0, 2, 4, ...) as the logical tracks.
+func doubleStep(d *disk) {
+	var trs []track
+	for t := 0; t < len(d.Tracks); t += 2 {
+		trs = append(trs, d.Tracks[t])
+	}
+	d.Tracks = trs
+	d.tracks = len(trs)
+	settleIDs(d)
+}
+
 // --- +3 directory helpers ---
 func specT0S1(d *disk) []byte {
-	if len(d.Tracks) == 0 {
+	if len(d.Tracks) == 0 || len(d.Tracks[0].Sectors) == 0 {
 		return nil
 	}
-	s := d.Tracks[0].ByID[1]
-	if s == nil || len(s.Data) < 16 {
-		return nil
+	trk := d.Tracks[0]
+	// The spec lives in the lowest-numbered sector, but some PCW disks (the kind SpecIDE
+	// copes with) number their sectors so that it is only the physically first one: if
+	// the lowest ID holds no spec, try the first sector in the Track-Info list.
+	var spec []byte
+	if s := trk.ByID[sectorID(d, 0, 1)]; s != nil && len(s.Data) >= 16 {
+		spec = s.Data[:16]
 	}
-	return s.Data[:16]
+	if s := &trk.Sectors[0]; !looksPlus3Spec(spec) && len(s.Data) >= 16 && looksPlus3Spec(s.Data[:16]) {
+		spec = s.Data[:16]
+	}
+	return spec
 }
+
+// looksPlus3Spec recognises a +3/PCW disk specification of any of the disk types in
+// specTypes: 180K single-sided as well as the double-sided, double-track 720K format.
 func looksPlus3Spec(b []byte) bool {
-	return b != nil && len(b) >= 16 && b[0] == 0 && (b[1] == 0 || b[1] == 1) && b[2] >= 40 && b[3] >= 9 && b[4] == 2 && b[6] == 3 && b[7] == 2
+	return b != nil && len(b) >= 16 && (b[0] == 0 || b[0] == 3) && b[1]&0x7C == 0 && b[1]&3 != 3 &&
+		b[2] >= 40 && b[3] >= 8 && b[4] == 2 && b[6] >= 3 && b[6] <= 7 && b[7] >= 1
 }
 
-type dirEntry struct {
-	User           byte
-	Name, Ext      string
-	EX, S1, S2, RC byte
-	Blocks         []byte
+// standardLayout reports whether the directory and block readers understand a spec's
+// layout: blocks, of whatever size BSH gives, that directory entries can number in 8
+// or 16 bits.
+func standardLayout(b []byte) bool {
+	sides := 1
+	if b[1]&3 != 0 {
+		sides = 2
+	}
+	blocks := (int(b[2])*sides - int(b[5])) * int(b[3]) * (128 << b[4]) / (128 << b[6])
+	return blocks <= 0x10000
 }
 
-func dirSectors(d *disk) ([][]byte, error) {
-	if len(d.Tracks) < 2 {
-		return nil, errors.New("no track 1")
+// Meanings of spec byte 0 (disk type) and byte 1 (sidedness in bits 0-1, bit 7 set
+// for double-track drives), as listed in the +3 and PCW technical documentation.
+var (
+	specTypes = map[byte]string{0: "+3/PCW CF2", 1: "CPC system", 2: "CPC data", 3: "PCW CF2DD"}
+	specSides = map[byte]string{0: "single-sided", 1: "double-sided (alternate sides)", 2: "double-sided (successive sides)"}
+)
+
+// describeSpec names the disk type, sidedness and track density a spec declares.
+func describeSpec(b []byte) string {
+	typ, ok := specTypes[b[0]]
+	if !ok {
+		typ = fmt.Sprintf("unknown type %d", b[0])
 	}
-	tr1 := d.Tracks[1]
-	secs := make([][]byte, 4)
-	for i := 1; i <= 4; i++ {
-		s := tr1.ByID[i]
-		if s == nil {
-			return nil, fmt.Errorf("missing directory R%d", i)
+	sides, ok := specSides[b[1]&3]
+	if !ok {
+		sides = "invalid sidedness"
+	}
+	density := "single-track"
+	if b[1]&0x80 != 0 {
+		density = "double-track"
+	}
+	return typ + ", " + sides + ", " + density
+}
+
+// geometry is a disk layout as recorded in a +3 spec; knownGeometries mirrors the
+// writer's KnownGeometries table so zx3info can tell which format an image follows.
+type geometry struct {
+	name                      string
+	tracks, sides, spt, ssize int
+	reserved, bsize, dirBlks  int
+}
+
+var knownGeometries = []geometry{
+	{"180k", 40, 1, 9, 512, 1, 1024, 2},
+	{"720k", 80, 2, 9, 512, 1, 2048, 4},
+}
+
+// defaultSpec is the standard +3 180K spec, which -assume-plus3 falls back on for the
+// fields of a spec that are not plausible. The +3 itself treats a disk without a valid
+// spec as this format.
+var defaultSpec = []byte{0, 0, 40, 9, 2, 1, 3, 2, 0x2A, 0x52, 0, 0, 0, 0, 0, 0}
+
+// assumeSpec builds the spec -assume-plus3 reads d by when T0,S1 holds the invalid
+// spec b: each field of b that is plausible for d by itself is kept, and the others are
+// taken from defaultSpec, so a disk with one stray byte is still read with its own
+// track count, block size and directory. It also returns the names of the fields
+// replaced.
+func assumeSpec(d *disk, b []byte) ([]byte, []string) {
+	spec := make([]byte, 16)
+	copy(spec, b)
+	spt := 0
+	if len(d.Tracks) > 0 {
+		spt = len(d.Tracks[0].Sectors)
+	}
+	fields := []struct {
+		i    int
+		name string
+		ok   bool
+	}{
+		{0, "type", spec[0] == 0 || spec[0] == 3},
+		{1, "sidedness", spec[1]&0x7C == 0 && spec[1]&3 != 3},
+		{2, "tracks", spec[2] >= 40 && int(spec[2]) <= d.tracks},
+		{3, "sectors per track", spec[3] >= 8 && int(spec[3]) <= spt},
+		{4, "sector size", spec[4] == 2},
+		{5, "reserved tracks", spec[5] >= 1 && spec[5] <= 4},
+		{6, "block size", spec[6] >= 3 && spec[6] <= 7},
+		{7, "directory blocks", spec[7] >= 1 && spec[7] <= 16},
+	}
+	var replaced []string
+	for _, f := range fields {
+		if !f.ok {
+			spec[f.i] = defaultSpec[f.i]
+			replaced = append(replaced, f.name)
 		}
-		if len(s.Data) != 512 {
-			return nil, fmt.Errorf("directory R%d len=%d (need 512)", i, len(s.Data))
+	}
+	return spec, replaced
+}
+
+// specGeometry reads the layout a spec declares.
+func specGeometry(b []byte) geometry {
+	sides := 1
+	if b[1]&3 != 0 {
+		sides = 2
+	}
+	return geometry{tracks: int(b[2]), sides: sides, spt: int(b[3]), ssize: 128 << b[4],
+		reserved: int(b[5]), bsize: 128 << b[6], dirBlks: int(b[7])}
+}
+
+// checkGeometry names the known geometry the spec matches and warns when the
+// image's Disk-Info track and side counts disagree with the spec.
+func checkGeometry(d *disk, b []byte) {
+	g := specGeometry(b)
+	name := "none known"
+	for _, k := range knownGeometries {
+		if g.name = k.name; g == k {
+			name = k.name
 		}
-		secs[i-1] = s.Data
 	}
-	return secs, nil
+	fmt.Printf(" Geometry: %s\n", name)
+	if d.tracks != g.tracks || d.sides != g.sides {
+		fmt.Printf(" Warning: image has %d track(s) x %d side(s) but the spec declares %d x %d\n", d.tracks, d.sides, g.tracks, g.sides)
+	}
 }
 
-func parseDir(secs [][]byte) []dirEntry {
-	buf := bytes.Join(secs, nil)
-	var out []dirEntry
-	for i := 0; i+32 <= len(buf); i += 32 {
-		e := buf[i : i+32]
-		if e[0] == 0xE5 {
-			continue
+// printSpec decodes the 16-byte +3/PCW disk specification. The R/W and format gaps
+// (bytes 8 and 9) are checked against the CF2 values 0x2A/0x52: non-standard gaps are
+// a common reason an image works in an emulator but not on a real +3.
+func printSpec(b []byte) {
+	fmt.Printf(" Format: %s\n", describeSpec(b))
+	fmt.Printf(" +3 spec: type %d, sidedness 0x%02X, %d tracks, %d sectors x %d, %d reserved track(s), %d-byte blocks, %d dir block(s)\n",
+		b[0], b[1], b[2], b[3], 128<<b[4], b[5], 128<<b[6], b[7])
+	gaps := "CF2 standard"
+	if b[8] != 0x2A || b[9] != 0x52 {
+		gaps = "NON-STANDARD (CF2 expects 0x2A/0x52)"
+	}
+	fmt.Printf(" Gaps: R/W 0x%02X, format 0x%02X (%s)\n", b[8], b[9], gaps)
+	fmt.Printf(" Checksum fiddle byte (15): 0x%02X\n", b[15])
+}
+
+// bootMachine names the machine that would boot from a disk whose first sector
+// sums (mod 256) to sum: the +3 ROM wants 3, the PCW8256/8512 255 and the PCW9512 1.
+func bootMachine(sum byte) string {
+	return map[byte]string{3: "+3", 255: "PCW8256/8512", 1: "PCW9512"}[sum]
+}
+
+// printDiskKind tells a CP/M system disk, whose extra reserved tracks carry the
+// system image, from a plain data disk, and says whether the boot sector would boot.
+func printDiskKind(d *disk, b []byte) {
+	kind := "data disk"
+	if b[5] > 1 {
+		kind = fmt.Sprintf("CP/M system disk (%d reserved tracks hold the system image)", b[5])
+	}
+	fmt.Printf(" Disk kind: %s\n", kind)
+
+	s := d.Tracks[0].ByID[sectorID(d, 0, 1)]
+	if s == nil || !hasBootCode(s.Data) {
+		fmt.Println(" Bootable: no (no boot record after the spec)")
+		return
+	}
+	var sum byte
+	for _, c := range s.Data {
+		sum += c
+	}
+	switch m := bootMachine(sum); {
+	case m == "+3":
+		fmt.Println(" Bootable: yes (checksum ok)")
+	case m != "":
+		fmt.Printf(" Bootable: no on a +3 (checksum 0x%02X, not 3), yes on the %s\n", sum, m)
+	default:
+		fmt.Printf(" Bootable: no (checksum bad: sector sums to 0x%02X, the +3 wants 3)\n", sum)
+	}
+}
+
+// hasBootCode reports whether a boot sector holds anything after the 16-byte spec:
+// a formatted but unused sector is uniform filler there.
+func hasBootCode(sec []byte) bool {
+	if len(sec) <= 16 {
+		return false
+	}
+	for _, c := range sec[16:] {
+		if c != sec[16] {
+			return true
 		}
-		out = append(out, dirEntry{
-			User: e[0],
-			Name: strings.TrimRight(string(e[1:9]), " "),
-			Ext:  strings.TrimRight(string(e[9:12]), " "),
-			EX:   e[12], S1: e[13], S2: e[14], RC: e[15],
-			Blocks: append([]byte(nil), e[16:32]...),
-		})
 	}
-	return out
+	return false
 }
 
-type fileAgg struct {
-	User      byte
-	Name, Ext string
-	Extents   []dirEntry
-	Bytes     int
+type dirEntry struct {
+	User           byte
+	Name, Ext      string // 7-bit, without the attribute bits
+	Attr           byte   // attrReadOnly | attrSystem | attrArchive
+	EX, S1, S2, RC byte
+	Blocks         []int // 8-bit or, on disks of more than 256 blocks, 16-bit numbers
+	Slot           int   // directory slot index
 }
 
-func aggregate(entries []dirEntry) []fileAgg {
-	type key struct {
-		User      byte
-		Name, Ext string
+// size is the number of bytes an entry covers: RC records past the EX&EXM full 16KB
+// extents its blocks also hold.
+func (e dirEntry) size(exm byte) int { return (int(e.EX&exm)*128 + int(e.RC)) * 128 }
+
+// CP/M file attributes, kept in bit 7 of the three extension bytes (t1' t2' t3').
+const (
+	attrReadOnly = 1 << iota
+	attrSystem
+	attrArchive
+)
+
+// attrNames lists the attributes set in a, e.g. "R/O SYS", or "" when there are none.
+func attrNames(a byte) string {
+	var out []string
+	for i, n := range []string{"R/O", "SYS", "ARC"} {
+		if a&(1<<i) != 0 {
+			out = append(out, n)
+		}
 	}
-	g := map[key][]dirEntry{}
-	for _, e := range entries {
-		g[key{e.User, e.Name, e.Ext}] = append(g[key{e.User, e.Name, e.Ext}], e)
+	return strings.Join(out, " ")
+}
+
+// idRun reports whether a track's sector IDs, each counted once, run without a gap,
+// and from which ID and how many.
+func idRun(trk track) (lo, n int, ok bool) {
+	if len(trk.Sectors) == 0 {
+		return 0, 0, false
 	}
-	var out []fileAgg
-	for k, exts := range g {
-		sort.Slice(exts, func(i, j int) bool {
-			ai := int(exts[i].S1)<<5 | int(exts[i].EX&0x1F)
-			aj := int(exts[j].S1)<<5 | int(exts[j].EX&0x1F)
-			return ai < aj
-		})
-		total := 0
-		for _, e := range exts {
-			total += int(e.RC) * 128
+	lo, hi := trk.Sectors[0].R, trk.Sectors[0].R
+	for _, s := range trk.Sectors {
+		lo, hi = min(lo, s.R), max(hi, s.R)
+	}
+	return lo, len(trk.ByID), hi-lo+1 == len(trk.ByID)
+}
+
+// settleIDs works out once for the disk the sector ID its tracks number from: 1 on +3
+// disks, 0 or 0x41 on some CPC and PCW formats. It is the run most gapless tracks share.
+func settleIDs(d *disk) {
+	type run struct{ lo, n int }
+	count := map[run]int{}
+	best := run{1, 0}
+	for _, trk := range d.Tracks {
+		lo, n, ok := idRun(trk)
+		if !ok {
+			continue
+		}
+		r := run{lo, n}
+		count[r]++
+		if count[r] > count[best] {
+			best = r
 		}
-		out = append(out, fileAgg{User: k.User, Name: k.Name, Ext: k.Ext, Extents: exts, Bytes: total})
 	}
-	sort.Slice(out, func(i, j int) bool {
-		if out[i].User != out[j].User {
-			return out[i].User < out[j].User
+	d.idBase, d.idSpan = best.lo, best.n
+}
+
+// sectorID maps the logical sector number se (1..N) of track record tr to its ID. Block
+// arithmetic counts sectors 1..N from the disk's ID base, or from the track's own lowest
+// ID when its IDs are a full gapless run. A track that lost or renamed a sector so still
+// reads from the disk's base, and the sector that is gone is reported instead of every
+// later one shifting down by one.
+func sectorID(d *disk, tr, se int) int {
+	if tr >= len(d.Tracks) {
+		return d.idBase + se - 1
+	}
+	if lo, n, ok := idRun(d.Tracks[tr]); ok && n == d.idSpan {
+		return lo + se - 1
+	}
+	return d.idBase + se - 1
+}
+
+// pickSector returns the best copy of sector R on a track: protected tracks can carry
+// several sectors with the same ID, so prefer a size-byte copy without ST error flags.
+func pickSector(trk track, r, size int) *sector {
+	var best *sector
+	score := func(s *sector) int {
+		n := 0
+		if len(s.Data) == size {
+			n += 2
 		}
-		if out[i].Name != out[j].Name {
-			return out[i].Name < out[j].Name
+		if s.ST1 == 0 && s.ST2 == 0 {
+			n++
 		}
-		return out[i].Ext < out[j].Ext
-	})
-	return out
+		return n
+	}
+	for i := range trk.Sectors {
+		s := &trk.Sectors[i]
+		if s.R == r && (best == nil || score(s) > score(best)) {
+			best = s
+		}
+	}
+	return best
 }
 
-func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <image.dsk>\n", os.Args[0])
-		os.Exit(2)
+// layout describes how the data area is laid over the image's tracks.
+type layout struct {
+	reserved, spt int // reserved (system) tracks, sectors per track
+	sides, cyls   int
+	successive    bool // double-sided, side 1 follows all of side 0 (else sides alternate)
+	secSize       int  // bytes per sector
+	blockSize     int  // bytes per allocation block
+	dirBlocks     int  // blocks reserved for the directory
+}
+
+// blockSectors is the number of sectors in one allocation block.
+func (l layout) blockSectors() int { return l.blockSize / l.secSize }
+
+// dataBlocks is the number of allocation blocks the formatted data area holds, directory included.
+func (l layout) dataBlocks() int {
+	return (l.cyls*l.sides - l.reserved) * l.spt * l.secSize / l.blockSize
+}
+
+// wide reports whether directory entries list 16-bit block numbers (eight little-endian
+// words) rather than sixteen bytes, as CP/M does on disks of more than 256 blocks.
+func (l layout) wide() bool { return l.dataBlocks() > 256 }
+
+// extentMask is CP/M's EXM: a directory entry's block numbers hold (EXM+1) 16KB
+// logical extents, so with 2KB blocks and 8-bit numbers one entry covers two of them.
+func (l layout) extentMask() byte {
+	per := 16
+	if l.wide() {
+		per = 8
 	}
-	path := os.Args[1]
-	d, err := parseDSK(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
-		os.Exit(1)
+	if l.blockSize*per < 16384 {
+		return 0
 	}
-	fmt.Printf("Disk: %s\n", path)
-	fmt.Printf(" Type: %s  Tracks: %d  Sides: %d\n",
-		map[diskType]string{dskStandard: "Standard", dskExtended: "Extended"}[d.kind], d.tracks, d.sides)
+	return byte(l.blockSize*per/16384 - 1)
+}
 
+// layoutOf derives the layout from the +3 spec, falling back to the 180K +3 layout
+// over the image's tracks. The data area is as long as the spec's track count says,
+// however many tracks the image holds; zx3extract derives it the same way. A
+// single-sided image is read single-sided whatever sidedness the spec claims. Without
+// a valid spec the one -assume-plus3 built, if any, is used.
+func layoutOf(d *disk) layout {
+	l := layout{reserved: 1, spt: 9, sides: 1, cyls: d.tracks, secSize: 512, blockSize: 1024, dirBlocks: 2}
 	spec := specT0S1(d)
 	if !looksPlus3Spec(spec) {
-		fmt.Println(" Not a +3 (PCW-180K) layout or missing +3 spec at T0,S1. Showing geometry only.")
-		return
+		spec = d.assumed
 	}
-	secs, err := dirSectors(d)
-	if err != nil {
-		fmt.Printf(" +3 spec found but directory not in +3 default layout: %v\n", err)
-		return
+	if looksPlus3Spec(spec) {
+		l.cyls, l.reserved, l.spt = int(spec[2]), int(spec[5]), int(spec[3])
+		l.secSize, l.blockSize, l.dirBlocks = 128<<spec[4], 128<<spec[6], int(spec[7])
+		if d.sides == 2 && spec[1]&3 != 0 {
+			l.sides, l.successive = 2, spec[1]&3 == 2
+		}
 	}
-	entries := parseDir(secs)
-	if len(entries) == 0 {
-		fmt.Println(" Directory: (empty)")
-		return
+	return l
+}
+
+// locate maps the n-th sector of the data area (0-based) to a track record and logical
+// sector number 1..spt (see sectorID for the ID).
+// Logical tracks count the reserved tracks; alternate-sided disks number them
+// cyl0/side0, cyl0/side1, ... like the records, successive ones run up side 0 and then side 1.
+func (l layout) locate(n int) (rec, r int) {
+	lt := l.reserved + n/l.spt
+	r = n%l.spt + 1
+	switch {
+	case l.sides == 1 || !l.successive:
+		rec = lt
+	case lt < l.cyls:
+		rec = lt * 2
+	default:
+		rec = (lt-l.cyls)*2 + 1
 	}
+	return rec, r
+}
 
-	fmt.Println("\nRaw directory entries:")
-	fmt.Println(" User  Name       Ext  Extent  RC   Blocks")
-	for _, e := range entries {
-		extentNum := int(e.S1)<<5 | int(e.EX&0x1F)
-		var blkIdxs []string
-		for _, b := range e.Blocks {
-			if b != 0 {
-				blkIdxs = append(blkIdxs, fmt.Sprintf("%d", int(b)))
-			}
+// commonSize is the sector size (from N) most sectors on a track declare.
+func commonSize(trk track) int {
+	count := map[int]int{}
+	best := 512
+	for _, s := range trk.Sectors {
+		size := 128 << (s.N & 7)
+		count[size]++
+		if count[size] > count[best] {
+			best = size
+		}
+	}
+	return best
+}
+
+// trackBytes reads n bytes starting off bytes into track tr, taking the track's sectors
+// in ID order (sectorID upwards) as one run of bytes. Blocks and the directory are laid
+// out in bytes, not sectors, so a directory track of 256-byte sectors reads the same as
+// data tracks of 512-byte ones.
+func trackBytes(d *disk, tr, off, n int) ([]byte, error) {
+	if tr >= len(d.Tracks) {
+		return nil, fmt.Errorf("track %d OOR", tr)
+	}
+	trk := d.Tracks[tr]
+	want := commonSize(trk)
+	out := make([]byte, 0, n)
+	pos := 0
+	for id := sectorID(d, tr, 1); len(out) < n; id++ {
+		s := pickSector(trk, id, want)
+		if s == nil && pos+want <= off {
+			pos += want // a missing sector before off only costs its place
+			continue
+		}
+		if s == nil {
+			return nil, fmt.Errorf("missing sector T%d R%d", tr, id)
 		}
-		fmt.Printf("  %3d  %-8s   %-3s  %5d  %3d  %s\n", int(e.User), e.Name, e.Ext, extentNum, int(e.RC), strings.Join(blkIdxs, ","))
+		size := 128 << (s.N & 7)
+		if len(s.Data) < size {
+			return nil, fmt.Errorf("sector T%d R%d len=%d (N=%d declares %d)", tr, id, len(s.Data), s.N, size)
+		}
+		if pos+size > off {
+			from := max(off-pos, 0)
+			out = append(out, s.Data[from:min(size, from+n-len(out))]...)
+		}
+		pos += size
+	}
+	return out, nil
+}
+
+// dirDuplicates lists the directory sector IDs that occur more than once on their track,
+// using the bitmap dirSectors recorded in d.
+func dirDuplicates(d *disk) []int {
+	var dups []int
+	for _, loc := range dirLocations(layoutOf(d), d.dirAL) {
+		if loc.rec >= len(d.Tracks) {
+			continue
+		}
+		id, n := sectorID(d, loc.rec, loc.r), 0
+		for _, s := range d.Tracks[loc.rec].Sectors {
+			if s.R == id {
+				n++
+			}
+		}
+		if n > 1 {
+			dups = append(dups, id)
+		}
+	}
+	return dups
+}
+
+// dirAllocation returns the AL0/AL1 directory allocation bitmap (AL0 in the high byte,
+// its top bit standing for block 0) that +3DOS builds from the layout's directory
+// block count.
+func dirAllocation(n int) uint16 {
+	if n > 16 {
+		n = 16
+	}
+	return ^uint16(0) << (16 - n)
+}
+
+// alBlocks lists the block numbers whose bits are set in an AL0/AL1 bitmap.
+func alBlocks(al uint16) []int {
+	var blocks []int
+	for b := 0; b < 16; b++ {
+		if al&(0x8000>>b) != 0 {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// isDirBlock reports whether block is reserved for the directory by the AL0/AL1 bitmap.
+func isDirBlock(al uint16, block int) bool {
+	return block < 16 && al&(0x8000>>block) != 0
+}
+
+// secLoc is a sector position: track record index and logical sector number.
+type secLoc struct{ rec, r int }
+
+// dirLocations lists every directory sector named by the AL0/AL1 bitmap, in directory
+// order. It is the one place the directory's extent is worked out: dirSectors and
+// dirDuplicates both read it, and the free-space count uses the same bitmap.
+func dirLocations(l layout, al uint16) []secLoc {
+	var locs []secLoc
+	for _, b := range alBlocks(al) {
+		for i := 0; i < l.blockSectors(); i++ {
+			rec, r := l.locate(b*l.blockSectors() + i)
+			locs = append(locs, secLoc{rec, r})
+		}
+	}
+	return locs
+}
+
+// dirSectors reads the directory blocks named by the AL0/AL1 bitmap, recording the
+// bitmap in d so later block reads can keep clear of the directory. Each piece is cut
+// from the directory track's own sectors, whatever size those are.
+func dirSectors(d *disk) ([][]byte, error) {
+	l := layoutOf(d)
+	d.dirAL = dirAllocation(l.dirBlocks)
+	var secs [][]byte
+	for _, loc := range dirLocations(l, d.dirAL) {
+		if loc.rec >= len(d.Tracks) {
+			return nil, fmt.Errorf("directory sector OOR (tr=%d)", loc.rec)
+		}
+		b, err := trackBytes(d, loc.rec, (loc.r-1)*l.secSize, l.secSize)
+		if err != nil {
+			return nil, fmt.Errorf("directory: %w", err)
+		}
+		secs = append(secs, b)
+	}
+	if len(secs) == 0 {
+		return nil, errors.New("spec reserves no directory blocks")
+	}
+	return secs, nil
+}
+
+// parseDir decodes the live entries of the directory sectors; wide entries list eight
+// 16-bit block numbers instead of sixteen 8-bit ones.
+func parseDir(secs [][]byte, wide bool) []dirEntry {
+	buf := bytes.Join(secs, nil)
+	var out []dirEntry
+	for i := 0; i+32 <= len(buf); i += 32 {
+		e := buf[i : i+32]
+		if e[0] == 0xE5 || e[0] == 0x20 || e[0] == 0x21 { // unused, the disk label (see dirLabel) or datestamps
+			continue
+		}
+		var nm [11]byte
+		for j := range nm {
+			nm[j] = e[1+j] & 0x7F
+		}
+		var attr byte
+		for j := 0; j < 3; j++ {
+			if e[9+j]&0x80 != 0 {
+				attr |= 1 << j
+			}
+		}
+		var blocks []int
+		for j := 16; j < 32; j++ {
+			if wide {
+				blocks = append(blocks, int(binary.LittleEndian.Uint16(e[j:])))
+				j++
+				continue
+			}
+			blocks = append(blocks, int(e[j]))
+		}
+		out = append(out, dirEntry{
+			User: e[0],
+			Name: strings.TrimRight(string(nm[:8]), " "),
+			Ext:  strings.TrimRight(string(nm[8:]), " "),
+			Attr: attr,
+			EX:   e[12], S1: e[13], S2: e[14], RC: e[15],
+			Blocks: blocks,
+			Slot:   i / 32,
+		})
+	}
+	return out
+}
+
+// dirLabel returns the disk label held by a CP/M 3 label entry (user byte 0x20), as
+// NAME.EXT with the attribute bits and padding removed, and whether there is one.
+func dirLabel(secs [][]byte) (string, bool) {
+	buf := bytes.Join(secs, nil)
+	for i := 0; i+32 <= len(buf); i += 32 {
+		if buf[i] != 0x20 {
+			continue
+		}
+		var nm [11]byte
+		for j := range nm {
+			nm[j] = buf[i+1+j] & 0x7F
+		}
+		name := strings.TrimRight(string(nm[:8]), " ")
+		if ext := strings.TrimRight(string(nm[8:]), " "); ext != "" {
+			name += "." + ext
+		}
+		return name, true
+	}
+	return "", false
+}
+
+// suspiciousUser reports user bytes that a +3/CP/M directory should not contain:
+// anything outside 0..15 other than 0xE5 (unused), 0x20 (CP/M 3 label) and 0x21
+// (datestamps). They usually mean a non-directory sector is being read as directory.
+func suspiciousUser(u byte) bool {
+	return u > 15 && u != 0xE5 && u != 0x20 && u != 0x21
+}
+
+// extentNumber returns the logical extent number of a directory entry:
+// EX holds the low 5 bits and S2 the extent module (high-order bits), per CP/M 2.2.
+func extentNumber(e dirEntry) int {
+	return int(e.S2&0x3F)<<5 | int(e.EX&0x1F)
+}
+
+type fileAgg struct {
+	User      byte
+	Name, Ext string
+	Attr      byte // every extent's attributes combined
+	Extents   []dirEntry
+	Bytes     int
+	Conflicts []extentConflict
+}
+
+// extentConflict records two directory entries of one file claiming the same extent number.
+type extentConflict struct {
+	Extent                int
+	KeptSlot, DroppedSlot int
+	KeptRC, DroppedRC     int
+}
+
+// dedupExtents drops entries that repeat an extent number (list must be sorted by extent number),
+// keeping the higher RC or, on a tie, the later directory slot.
+func dedupExtents(list []dirEntry) ([]dirEntry, []extentConflict) {
+	var out []dirEntry
+	var conflicts []extentConflict
+	for _, e := range list {
+		n := len(out)
+		if n == 0 || extentNumber(out[n-1]) != extentNumber(e) {
+			out = append(out, e)
+			continue
+		}
+		keep, drop := out[n-1], e
+		if e.RC > keep.RC || (e.RC == keep.RC && e.Slot > keep.Slot) {
+			keep, drop = e, out[n-1]
+		}
+		out[n-1] = keep
+		conflicts = append(conflicts, extentConflict{
+			Extent:   extentNumber(e),
+			KeptSlot: keep.Slot, KeptRC: int(keep.RC),
+			DroppedSlot: drop.Slot, DroppedRC: int(drop.RC),
+		})
+	}
+	return out, conflicts
+}
+
+// filesInUser keeps the files in CP/M user area user; a negative user keeps them all.
+func filesInUser(files []fileAgg, user int) []fileAgg {
+	if user < 0 {
+		return files
+	}
+	var out []fileAgg
+	for _, f := range files {
+		if int(f.User) == user {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// wildMatch83 matches a CP/M wildcard against a file's name and extension, field by
+// field as CCP does: each side of the dot is padded to 8 (or 3) characters, '?' takes
+// any character including the padding and '*' fills the rest of its field with '?'.
+// A pattern without a dot matches only files without an extension. Case is ignored.
+// zx3extract's -match uses the same function.
+func wildMatch83(pattern, name, ext string) bool {
+	pb, pe, _ := strings.Cut(strings.ToUpper(pattern), ".")
+	field := func(p, s string, n int) bool {
+		if i := strings.IndexByte(p, '*'); i >= 0 {
+			p = p[:i] + strings.Repeat("?", max(0, n-i))
+		}
+		p, s = fmt.Sprintf("%-*s", n, p), fmt.Sprintf("%-*s", n, strings.ToUpper(s))
+		if len(p) != n || len(s) != n {
+			return false // longer than the field: no 8.3 name matches
+		}
+		for i := 0; i < n; i++ {
+			if p[i] != '?' && p[i] != s[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return field(pb, strings.TrimRight(name, " "), 8) && field(pe, strings.TrimRight(ext, " "), 3)
+}
+
+// aggregate groups the entries into files; exm is the layout's extent mask, which
+// sizes each entry.
+func aggregate(entries []dirEntry, exm byte) []fileAgg {
+	type key struct {
+		User      byte
+		Name, Ext string
+	}
+	g := map[key][]dirEntry{}
+	for _, e := range entries {
+		g[key{e.User, e.Name, e.Ext}] = append(g[key{e.User, e.Name, e.Ext}], e)
+	}
+	var out []fileAgg
+	for k, exts := range g {
+		sort.Slice(exts, func(i, j int) bool {
+			return extentNumber(exts[i]) < extentNumber(exts[j])
+		})
+		exts, conflicts := dedupExtents(exts)
+		total := 0
+		var attr byte
+		for _, e := range exts {
+			total += e.size(exm)
+			attr |= e.Attr
+		}
+		out = append(out, fileAgg{User: k.User, Name: k.Name, Ext: k.Ext, Attr: attr, Extents: exts, Bytes: total, Conflicts: conflicts})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].User != out[j].User {
+			return out[i].User < out[j].User
+		}
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Ext < out[j].Ext
+	})
+	return out
+}
+
+// Map absolute block number (0-based from start of data area) to bytes from the disk image.
+// The data area starts after the reserved tracks; layoutOf supplies the geometry. Sectors
+// are taken as byte ranges of their track, so tracks of another sector size read the same.
+func getBlock(d *disk, block int) ([]byte, error) {
+	l := layoutOf(d)
+	var out bytes.Buffer
+	for i := 0; i < l.blockSectors(); i++ {
+		tr, se := l.locate(block*l.blockSectors() + i)
+		if tr >= len(d.Tracks) {
+			return nil, fmt.Errorf("block %d OOR (tr=%d)", block, tr)
+		}
+		b, err := trackBytes(d, tr, (se-1)*l.secSize, l.secSize)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(b)
+	}
+	return out.Bytes(), nil
+}
+
+// blockSectorNames lists the sectors holding a block as "T<track> R<id>".
+func blockSectorNames(d *disk, l layout, block int) string {
+	var at []string
+	for i := 0; i < l.blockSectors(); i++ {
+		tr, se := l.locate(block*l.blockSectors() + i)
+		at = append(at, fmt.Sprintf("T%s R%d", d.trackLabel(tr), sectorID(d, tr, se)))
+	}
+	return strings.Join(at, ", ")
+}
+
+// traceFile walks name (NAME.EXT, case-insensitive) from its directory entries through
+// extents and allocation blocks down to sectors, printing the file offsets each covers.
+func traceFile(d *disk, files []fileAgg, name string) bool {
+	found := false
+	for _, f := range files {
+		if !strings.EqualFold(fsName(f), name) {
+			continue
+		}
+		found = true
+		fmt.Printf("\nTrace of %s, user %d: %d extent(s), %d bytes by record count\n", fsName(f), f.User, len(f.Extents), f.Bytes)
+		off := 0
+		l := layoutOf(d)
+		for _, e := range f.Extents {
+			size := e.size(l.extentMask())
+			fmt.Printf(" Directory slot %d: extent %d (EX=%d S2=%d), RC=%d -> %d bytes at file offset %d\n",
+				e.Slot, extentNumber(e), e.EX, e.S2, e.RC, size, off)
+			left := size
+			for _, b := range e.Blocks {
+				if b == 0 {
+					continue
+				}
+				at := blockSectorNames(d, l, b)
+				if isDirBlock(d.dirAL, b) {
+					fmt.Printf("   block %3d -> %s  (directory block, not read as file data)\n", b, at)
+					continue
+				}
+				n := min(left, l.blockSize)
+				if n == 0 {
+					fmt.Printf("   block %3d -> %s  (allocated beyond RC, unused)\n", b, at)
+					continue
+				}
+				fmt.Printf("   block %3d -> %s  file bytes %d..%d (0x%04X..0x%04X)\n",
+					b, at, off, off+n-1, off, off+n-1)
+				off += n
+				left -= n
+			}
+			if left > 0 {
+				fmt.Printf("   %d byte(s) of this extent have no block allocated\n", left)
+				off += left
+			}
+		}
+	}
+	return found
+}
+
+// listExtents prints every file's extents in the order extraction reads them.
+func listExtents(files []fileAgg) {
+	fmt.Println("\nExtent chains:")
+	for _, f := range files {
+		attrs := ""
+		if a := attrNames(f.Attr); a != "" {
+			attrs = " [" + a + "]"
+		}
+		fmt.Printf(" %3d  %s%s: %d extent(s), %d bytes by record count\n", f.User, fsName(f), attrs, len(f.Extents), f.Bytes)
+		for _, e := range f.Extents {
+			var blks []string
+			for _, b := range e.Blocks {
+				if b != 0 {
+					blks = append(blks, fmt.Sprint(b))
+				}
+			}
+			if len(blks) == 0 {
+				blks = []string{"-"}
+			}
+			fmt.Printf("      extent %3d  EX=%-2d S2=%-2d RC=%-3d slot %-3d blocks %s\n",
+				extentNumber(e), e.EX, e.S2, e.RC, e.Slot, strings.Join(blks, ","))
+		}
+	}
+}
+
+// headerChecksum reads the first record of f through the lazy reader and reports its
+// +3DOS header checksum as "OK", "bad (...)" or "none" for a headerless file.
+func headerChecksum(d *disk, f fileAgg) (status string, bad bool) {
+	h := make([]byte, 128)
+	if _, err := io.ReadFull(newFileReader(d, f), h); err != nil || !bytes.HasPrefix(h, []byte("PLUS3DOS\x1A")) {
+		return "none", false
+	}
+	var sum byte
+	for _, c := range h[:127] {
+		sum += c
+	}
+	if sum != h[127] {
+		return fmt.Sprintf("bad (stored 0x%02X, computed 0x%02X)", h[127], sum), true
+	}
+	return "OK", false
+}
+
+// verifyChecksums lists the header checksum status of every file and reports
+// whether any headed file failed.
+func verifyChecksums(d *disk, files []fileAgg) (anyBad bool) {
+	fmt.Println("\nHeader checksums:")
+	fmt.Println(" User  File          Checksum")
+	for _, f := range files {
+		status, bad := headerChecksum(d, f)
+		anyBad = anyBad || bad
+		fmt.Printf("  %3d  %-12s  %s\n", f.User, fsName(f), status)
+	}
+	return anyBad
+}
+
+// previewBytes returns up to n bytes from the start of f's data, after any +3DOS
+// header and within its DataLength, read through the lazy reader.
+func previewBytes(d *disk, f fileAgg, n int) []byte {
+	buf := make([]byte, 128+n)
+	got, _ := io.ReadFull(newFileReader(d, f), buf)
+	buf = buf[:got]
+	if got >= 128 && bytes.HasPrefix(buf, []byte("PLUS3DOS\x1A")) {
+		dataLen := int(binary.LittleEndian.Uint16(buf[16:18]))
+		buf = buf[128:]
+		buf = buf[:min(len(buf), dataLen)]
+	}
+	return buf[:min(len(buf), n)]
+}
+
+// --- NDJSON catalog ---
+
+// extentJSON and fileJSON are the -json-stream record layout; field names follow
+// zx3extract's -meta files.
+type extentJSON struct {
+	Extent int   `json:"extent"`
+	RC     int   `json:"rc"`
+	Slot   int   `json:"slot"`
+	Blocks []int `json:"blocks"`
+}
+
+type fileJSON struct {
+	Image      string       `json:"image"`
+	User       int          `json:"user"`
+	Name       string       `json:"name"`
+	Ext        string       `json:"ext"`
+	ReadOnly   bool         `json:"read_only,omitempty"`
+	System     bool         `json:"system,omitempty"`
+	Archive    bool         `json:"archive,omitempty"`
+	TotalBytes int          `json:"total_bytes_from_rc"`
+	Kind       string       `json:"kind,omitempty"`       // fileKind; left out with -info-only
+	SHA256     string       `json:"sha256,omitempty"`     // of the bytes read, header included; left out with -info-only
+	Unreadable string       `json:"unreadable,omitempty"` // why the bytes could not be read to hash them
+	Extents    []extentJSON `json:"extents"`
+}
+
+// catalogFiles checks that d carries a directory this tool can list and returns its
+// files in user area user (every area if user < 0), aggregated, with duplicate-extent
+// warnings on stderr.
+func catalogFiles(path string, d *disk, assume bool, user int) ([]fileAgg, error) {
+	spec := specT0S1(d)
+	if !looksPlus3Spec(spec) {
+		if !assume {
+			return nil, errors.New("no +3 spec at T0,S1")
+		}
+		var replaced []string
+		spec, replaced = assumeSpec(d, spec)
+		d.assumed = spec
+		fmt.Fprintf(os.Stderr, "%s: no +3 spec at T0,S1; assuming the standard 180K value of its %s\n", path, strings.Join(replaced, ", "))
+	}
+	if !standardLayout(spec) {
+		return nil, fmt.Errorf("directory listing is not supported for this layout (%s)", describeSpec(spec))
+	}
+	secs, err := dirSectors(d)
+	if err != nil {
+		return nil, err
+	}
+	l := layoutOf(d)
+	files := filesInUser(aggregate(parseDir(secs, l.wide()), l.extentMask()), user)
+	for _, f := range files {
+		for _, c := range f.Conflicts {
+			fmt.Fprintf(os.Stderr, "Warning: %s.%s has duplicate extent %d (slots %d and %d); using slot %d (RC %d)\n",
+				f.Name, f.Ext, c.Extent, c.KeptSlot, c.DroppedSlot, c.KeptSlot, c.KeptRC)
+		}
+	}
+	return files, nil
+}
+
+// fileHash returns the hex SHA-256 of a file's bytes as its extents give them, or
+// the error that stopped one of its blocks being read.
+func fileHash(d *disk, f fileAgg) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, newFileReader(d, f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// streamCatalog writes one JSON object per file to w, each on its own line, as the
+// files are aggregated. Diagnostics go to stderr so w carries nothing but NDJSON.
+func streamCatalog(w io.Writer, path string, d *disk, withKind, assume bool, user int) error {
+	files, err := catalogFiles(path, d, assume, user)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, f := range files {
+		rec := fileJSON{Image: path, User: int(f.User), Name: f.Name, Ext: f.Ext, TotalBytes: f.Bytes, Extents: []extentJSON{},
+			ReadOnly: f.Attr&attrReadOnly != 0, System: f.Attr&attrSystem != 0, Archive: f.Attr&attrArchive != 0}
+		if withKind {
+			rec.Kind = fileKind(d, f)
+			sum, err := fileHash(d, f)
+			if err != nil {
+				rec.Unreadable = err.Error()
+				fmt.Fprintf(os.Stderr, "Warning: %s: %s is unreadable: %v\n", path, fsName(f), err)
+			}
+			rec.SHA256 = sum
+		}
+		for _, e := range f.Extents {
+			x := extentJSON{Extent: extentNumber(e), RC: int(e.RC), Slot: e.Slot, Blocks: []int{}}
+			for _, b := range e.Blocks {
+				if b != 0 {
+					x.Blocks = append(x.Blocks, int(b))
+				}
+			}
+			rec.Extents = append(rec.Extents, x)
+		}
+		if err := enc.Encode(rec); err != nil { // one Write per line, so each record is flushed as it goes
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyCatalog compares the files on d with a reference catalog in the -json-stream
+// format and returns one line per missing, extra or altered file. Records without a
+// sha256 are checked by size alone.
+func verifyCatalog(ref, path string, d *disk, assume bool, user int) ([]string, error) {
+	f, err := os.Open(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	type key struct {
+		user      int
+		name, ext string
+	}
+	want := map[key]fileJSON{}
+	var order []key
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec fileJSON
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", ref, line, err)
+		}
+		if user >= 0 && rec.User != user {
+			continue
+		}
+		k := key{rec.User, rec.Name, rec.Ext}
+		if _, dup := want[k]; !dup {
+			order = append(order, k)
+		}
+		want[k] = rec
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	files, err := catalogFiles(path, d, assume, user)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	seen := map[key]bool{}
+	for _, fa := range files {
+		k := key{int(fa.User), fa.Name, fa.Ext}
+		seen[k] = true
+		name := fmt.Sprintf("%d:%s.%s", fa.User, fa.Name, fa.Ext)
+		rec, ok := want[k]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("extra: %s (%d bytes)", name, fa.Bytes))
+		case rec.TotalBytes != fa.Bytes:
+			problems = append(problems, fmt.Sprintf("altered: %s is %d bytes, the catalog has %d", name, fa.Bytes, rec.TotalBytes))
+		case rec.SHA256 != "":
+			sum, err := fileHash(d, fa)
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("unreadable: %s: %v", name, err))
+			case !strings.EqualFold(sum, rec.SHA256):
+				problems = append(problems, fmt.Sprintf("altered: %s has sha256 %s, the catalog has %s", name, sum, rec.SHA256))
+			}
+		}
+	}
+	for _, k := range order {
+		if !seen[k] {
+			problems = append(problems, fmt.Sprintf("missing: %d:%s.%s", k.user, k.name, k.ext))
+		}
+	}
+	return problems, nil
+}
+
+// --- per-file reader ---
+
+type blockSpan struct{ block, n int }
+
+// fileReader streams a file's bytes one block at a time, extent by extent,
+// honouring each extent's record count, so a file is never loaded whole.
+type fileReader struct {
+	d     *disk
+	spans []blockSpan
+	buf   []byte
+}
+
+func newFileReader(d *disk, f fileAgg) *fileReader {
+	r := &fileReader{d: d}
+	l := layoutOf(d)
+	for _, e := range f.Extents {
+		want := e.size(l.extentMask())
+		for _, b := range e.Blocks {
+			if b == 0 || want <= 0 || isDirBlock(d.dirAL, b) {
+				continue
+			}
+			n := min(want, l.blockSize)
+			r.spans = append(r.spans, blockSpan{b, n})
+			want -= n
+		}
+	}
+	return r
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.spans) == 0 {
+			return 0, io.EOF
+		}
+		sp := r.spans[0]
+		r.spans = r.spans[1:]
+		b, err := getBlock(r.d, sp.block)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = b[:sp.n]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// --- io/fs view ---
+
+// diskFS exposes a parsed +3 disk as a read-only fs.FS so io/fs tooling
+// (fs.WalkDir, fs.ReadFile, ...) works on its contents. Every file appears in the
+// root directory as NAME.EXT (NAME when there is no extension); names are matched
+// case-insensitively and, if a name exists under several user numbers, the lowest
+// user wins. File data is streamed through fileReader. A file's mod time is the
+// CP/M 3 update stamp of its first extent (the create stamp when no update is
+// recorded), or zero on a disk without datestamps.
+type diskFS struct {
+	d      *disk
+	files  map[string]fileAgg
+	names  []string
+	stamps map[int]time.Time // directory slot -> datestamp
+}
+
+func newDiskFS(d *disk, files []fileAgg) *diskFS {
+	fsys := &diskFS{d: d, files: map[string]fileAgg{}}
+	if secs, err := dirSectors(d); err == nil {
+		fsys.stamps = dirStamps(secs)
+	}
+	for _, f := range files { // aggregate() order: lowest user first
+		name := fsName(f)
+		if _, dup := fsys.files[name]; dup {
+			continue
+		}
+		fsys.files[name] = f
+		fsys.names = append(fsys.names, name)
+	}
+	sort.Strings(fsys.names)
+	return fsys
+}
+
+func fsName(f fileAgg) string {
+	if f.Ext == "" {
+		return f.Name
+	}
+	return f.Name + "." + f.Ext
+}
+
+func (fsys *diskFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &dskDir{fsys: fsys}, nil
+	}
+	f, ok := fsys.files[strings.ToUpper(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return fsys.open(f), nil
+}
+
+func (fsys *diskFS) open(f fileAgg) *dskFile {
+	r := newFileReader(fsys.d, f)
+	size := 0
+	for _, sp := range r.spans {
+		size += sp.n
+	}
+	info := dskInfo{name: fsName(f), size: int64(size)}
+	if len(f.Extents) > 0 {
+		info.mod = fsys.stamps[f.Extents[0].Slot]
+	}
+	return &dskFile{info: info, r: r}
+}
+
+// dirStamps decodes the CP/M 3 datestamp entries (user byte 0x21 in every fourth
+// slot, stamping the three before it) and returns, by directory slot, each entry's
+// update time, or its create time when no update is recorded.
+func dirStamps(secs [][]byte) map[int]time.Time {
+	buf := bytes.Join(secs, nil)
+	stamps := map[int]time.Time{}
+	for i := 3 * 32; i+32 <= len(buf); i += 4 * 32 {
+		if buf[i] != 0x21 {
+			continue
+		}
+		for j := 0; j < 3; j++ {
+			st := buf[i+1+j*10:]
+			t, ok := cpmTime(st[4:8])
+			if !ok {
+				t, ok = cpmTime(st[:4])
+			}
+			if ok {
+				stamps[i/32-3+j] = t
+			}
+		}
+	}
+	return stamps
+}
+
+// cpmTime decodes a CP/M 3 datestamp: the day number (1 = 1 January 1978) in two
+// little-endian bytes, then the hour and minute in BCD. Day 0 means no stamp.
+func cpmTime(b []byte) (time.Time, bool) {
+	days := int(binary.LittleEndian.Uint16(b))
+	if days == 0 {
+		return time.Time{}, false
+	}
+	bcd := func(v byte) int { return int(v>>4)*10 + int(v&0x0F) }
+	return time.Date(1977, 12, 31+days, bcd(b[2]), bcd(b[3]), 0, 0, time.UTC), true
+}
+
+type dskInfo struct {
+	name string
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+func (i dskInfo) Name() string       { return i.name }
+func (i dskInfo) Size() int64        { return i.size }
+func (i dskInfo) ModTime() time.Time { return i.mod }
+func (i dskInfo) IsDir() bool        { return i.dir }
+func (i dskInfo) Sys() any           { return nil }
+func (i dskInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type dskFile struct {
+	info dskInfo
+	r    *fileReader
+}
+
+func (f *dskFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *dskFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *dskFile) Close() error               { return nil }
+
+// dskDir is the root directory; it is the only directory in the file system.
+type dskDir struct {
+	fsys *diskFS
+	pos  int
+}
+
+func (d *dskDir) Stat() (fs.FileInfo, error) { return dskInfo{name: ".", dir: true}, nil }
+func (d *dskDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+func (d *dskDir) Close() error { return nil }
+
+func (d *dskDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.fsys.names[d.pos:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	out := make([]fs.DirEntry, len(rest))
+	for i, name := range rest {
+		out[i] = fs.FileInfoToDirEntry(d.fsys.open(d.fsys.files[name]).info)
+	}
+	d.pos += len(rest)
+	return out, nil
+}
+
+// --- content search ---
+
+// findAll returns the offsets of every occurrence of pat in r, reading it
+// incrementally and carrying len(pat)-1 bytes across reads so no match is missed.
+func findAll(r io.Reader, pat []byte) ([]int, error) {
+	var offs []int
+	var window []byte
+	base := 0 // file offset of window[0]
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		window = append(window, buf[:n]...)
+		for i := 0; ; {
+			j := bytes.Index(window[i:], pat)
+			if j < 0 {
+				break
+			}
+			offs = append(offs, base+i+j)
+			i += j + 1
+		}
+		if keep := len(pat) - 1; len(window) > keep {
+			base += len(window) - keep
+			window = append([]byte(nil), window[len(window)-keep:]...)
+		}
+		if err == io.EOF {
+			return offs, nil
+		}
+		if err != nil {
+			return offs, err
+		}
+	}
+}
+
+func parsePattern(s string, text bool) ([]byte, error) {
+	if text {
+		return []byte(s), nil
+	}
+	s = strings.NewReplacer(" ", "", ":", "", "0x", "").Replace(s)
+	return hex.DecodeString(s)
+}
+
+// --- archive summary ---
+
+// fileKind classifies a file from its +3DOS header, read through the lazy reader.
+func fileKind(d *disk, f fileAgg) string {
+	h := make([]byte, 128)
+	if _, err := io.ReadFull(newFileReader(d, f), h); err != nil || !bytes.HasPrefix(h, []byte("PLUS3DOS\x1A")) {
+		return "headerless"
+	}
+	switch h[15] {
+	case 0:
+		return "BASIC"
+	case 1:
+		return "numeric array"
+	case 2:
+		return "char array"
+	case 3:
+		if binary.LittleEndian.Uint16(h[16:18]) == 6912 && binary.LittleEndian.Uint16(h[18:20]) == 0x4000 {
+			return "SCREEN$"
+		}
+		return "CODE"
+	}
+	return fmt.Sprintf("type %d", h[15])
+}
+
+// imageSummary is the per-image result of -summary.
+type imageSummary struct {
+	path    string
+	err     error          // image failed to parse
+	files   int            // files in the +3 directory
+	bytes   int            // RC-derived bytes of those files
+	kinds   map[string]int // file count per fileKind
+	unusual []string       // reasons the disk is non-standard (protection, odd layout, ...)
+}
+
+func summarizeImage(path string) imageSummary {
+	sum := imageSummary{path: path, kinds: map[string]int{}}
+	d, err := parseDSK(path, -1)
+	if err != nil {
+		sum.err = err
+		return sum
+	}
+	if isDoubleStepped(d) {
+		doubleStep(d)
+		sum.unusual = append(sum.unusual, "double-stepped")
+	}
+	for t, trk := range d.Tracks {
+		odd := len(trk.Sectors) != 9
+		for _, sec := range trk.Sectors {
+			if len(sec.Data) != 512 {
+				odd = true
+			}
+		}
+		if odd && len(trk.Sectors) > 0 {
+			sum.unusual = append(sum.unusual, fmt.Sprintf("non-standard sector layout from track %s", d.trackLabel(t)))
+			break
+		}
+	}
+	if !looksPlus3Spec(specT0S1(d)) {
+		sum.unusual = append(sum.unusual, "no +3 spec")
+		return sum
+	}
+	if n := specT0S1(d)[5]; n > 1 {
+		sum.unusual = append(sum.unusual, fmt.Sprintf("CP/M system disk (%d reserved tracks)", n))
+	}
+	if !standardLayout(specT0S1(d)) {
+		sum.unusual = append(sum.unusual, describeSpec(specT0S1(d)))
+		return sum
+	}
+	secs, err := dirSectors(d)
+	if err != nil {
+		sum.unusual = append(sum.unusual, "directory: "+err.Error())
+		return sum
+	}
+	l := layoutOf(d)
+	entries := parseDir(secs, l.wide())
+	for _, e := range entries {
+		if suspiciousUser(e.User) {
+			sum.unusual = append(sum.unusual, "suspicious directory entries")
+			break
+		}
+	}
+	for _, f := range aggregate(entries, l.extentMask()) {
+		if f.User > 15 { // labels, datestamps, garbage
+			continue
+		}
+		sum.files++
+		sum.bytes += f.Bytes
+		sum.kinds[fileKind(d, f)]++
+	}
+	return sum
+}
+
+// summarizeAll runs summarizeImage over paths on a pool of GOMAXPROCS workers.
+// Each image is parsed independently; results come back in the order of paths.
+func summarizeAll(paths []string) []imageSummary {
+	results := make([]imageSummary, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = summarizeImage(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// summarize walks root for .dsk images and prints archive-level statistics.
+func summarize(root string) error {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.Type().IsRegular() && strings.EqualFold(filepath.Ext(path), ".dsk") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	var files, total int
+	kinds := map[string]int{}
+	var unusual, failed []imageSummary
+	for _, sum := range summarizeAll(paths) {
+		if sum.err != nil {
+			failed = append(failed, sum)
+			continue
+		}
+		files += sum.files
+		total += sum.bytes
+		for k, n := range sum.kinds {
+			kinds[k] += n
+		}
+		if len(sum.unusual) > 0 {
+			unusual = append(unusual, sum)
+		}
+	}
+
+	fmt.Printf("Summary: %s\n", root)
+	fmt.Printf(" Images: %d (%d failed to parse)\n", len(paths), len(failed))
+	fmt.Printf(" Files:  %d\n", files)
+	fmt.Printf(" Bytes:  %d\n", total)
+	if len(kinds) > 0 {
+		fmt.Println(" File types:")
+		var names []string
+		for k := range kinds {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Printf("  %-14s %d\n", k, kinds[k])
+		}
+	}
+	fmt.Printf(" Unusual/protected disks: %d\n", len(unusual))
+	for _, u := range unusual {
+		fmt.Printf("  %s: %s\n", u.path, strings.Join(u.unusual, "; "))
+	}
+	if len(failed) > 0 {
+		fmt.Println(" Failed to parse:")
+		for _, f := range failed {
+			fmt.Printf("  %s: %v\n", f.path, f.err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flagDoubleStep := flag.Bool("doublestep", false, "read every other track (40-track disk stored in an 80-track image); auto-detected when possible")
+	flagTracks := flag.Bool("tracks", false, "list per-track Track-Info fields (data rate, recording mode, gap, filler) and exit")
+	flagListTracks := flag.Bool("list-tracks", false, "compact per-track geometry: cylinder, head, sector count, sector sizes, ST flags; then exit")
+	flagSectors := flag.Bool("sectors", false, "list every sector with its ST1/ST2 status flags (deleted-data marks called out) and exit")
+	flagFind := flag.String("find", "", "search every file for a byte pattern given as hex (e.g. \"F3 AF\") and report file offsets")
+	flagText := flag.Bool("text", false, "treat the -find pattern as ASCII text instead of hex")
+	flagInfoOnly := flag.Bool("info-only", false, "fast catalog: load only the spec and directory tracks, skipping all other sector data")
+	flagSummary := flag.Bool("summary", false, "print aggregate statistics for every .dsk below a directory: -summary <dir>")
+	flagListExtents := flag.Bool("list-extents", false, "list each file's extents (number, EX/S2, RC, slot, blocks) in extraction order")
+	flagPreview := flag.Int("preview", 0, "show the first N data bytes of each file (after any +3DOS header) in hex beside its first directory entry")
+	flagChecksums := flag.Bool("verify-checksums", false, "report each file's +3DOS header checksum as OK, bad or none (exit status 1 if any is bad)")
+	flagAssume := flag.Bool("assume-plus3", false, "read the directory even when T0,S1 holds no valid +3 spec, keeping the spec's plausible fields and taking the rest from the standard 180K +3 layout")
+	flagVerifyCatalog := flag.String("verify-catalog", "", "check every file against a reference catalog written by -json-stream (presence, size, sha256); exit status 1 on any difference")
+	flagJSONStream := flag.Bool("json-stream", false, "write the catalog as NDJSON, one object per file per line, and nothing else to stdout")
+	flagGapData := flag.Bool("gapdata", false, "report tracks whose padding after the sector data is not filler (hidden data) and exit")
+	flagUser := flag.Int("user", -1, "list only files in CP/M user area N (0..15); -1 lists every user area")
+	flagMatch := flag.String("match", "", "list only files whose NAME.EXT matches a CP/M wildcard such as \"*.BAS\" or \"GAME?.*\"")
+	flagTrace := flag.String("trace", "", "show how NAME.EXT maps from directory entries to extents, blocks, sectors and file offsets")
+	flagCat := flag.String("cat", "", "write NAME.EXT to stdout as its extents give it (+3DOS header included) and nothing else; with -user, the copy in that user area")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-doublestep] [-tracks] [-list-tracks] [-sectors] [-gapdata] [-info-only] [-find PATTERN [-text]] [-list-extents] [-verify-checksums] [-preview N] [-assume-plus3] [-trace NAME.EXT] [-cat NAME.EXT] [-json-stream] [-verify-catalog REF.json] [-user N] [-match PATTERN] <image.dsk>\n       %s -summary <dir>\n", os.Args[0], os.Args[0])
+		os.Exit(2)
+	}
+	if *flagUser < -1 || *flagUser > 15 {
+		fmt.Fprintf(os.Stderr, "-user %d out of range 0..15\n", *flagUser)
+		os.Exit(2)
+	}
+	if *flagSummary {
+		if err := summarize(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Summary error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	path := flag.Arg(0)
+	fullTracks := -1
+	if *flagInfoOnly {
+		if *flagFind != "" || *flagPreview > 0 || *flagGapData || *flagVerifyCatalog != "" || *flagCat != "" {
+			fmt.Fprintf(os.Stderr, "-find, -preview, -gapdata, -verify-catalog and -cat need track data; they cannot be combined with -info-only\n")
+			os.Exit(2)
+		}
+		fullTracks = 2 // T0 (spec) and T1 (directory)
+		if *flagDoubleStep {
+			fullTracks = 3 // logical track 1 is physical track 2
+		}
+	}
+	d, err := parseDSK(path, fullTracks)
+	if err == nil && fullTracks >= 0 {
+		// load every track up to the last directory sector, past any reserved tracks
+		if spec := specT0S1(d); *flagAssume && !looksPlus3Spec(spec) {
+			d.assumed, _ = assumeSpec(d, spec)
+		}
+		need := 0
+		l := layoutOf(d)
+		for _, loc := range dirLocations(l, dirAllocation(l.dirBlocks)) {
+			need = max(need, loc.rec+1)
+		}
+		if *flagDoubleStep {
+			need = need*2 - 1
+		}
+		if need > fullTracks {
+			d, err = parseDSK(path, need)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+		os.Exit(1)
+	}
+	if *flagVerifyCatalog != "" {
+		if *flagDoubleStep || isDoubleStepped(d) {
+			doubleStep(d)
+		}
+		problems, err := verifyCatalog(*flagVerifyCatalog, path, d, *flagAssume, *flagUser)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			fmt.Printf("%s: %d difference(s) from %s\n", path, len(problems), *flagVerifyCatalog)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: matches %s\n", path, *flagVerifyCatalog)
+		return
+	}
+	if *flagJSONStream {
+		if *flagDoubleStep || (!*flagInfoOnly && isDoubleStepped(d)) {
+			doubleStep(d)
+		}
+		if err := streamCatalog(os.Stdout, path, d, !*flagInfoOnly, *flagAssume, *flagUser); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *flagCat != "" {
+		if *flagDoubleStep || isDoubleStepped(d) {
+			doubleStep(d)
+		}
+		files, err := catalogFiles(path, d, *flagAssume, *flagUser)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		b, err := fs.ReadFile(newDiskFS(d, files), *flagCat)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(b)
+		return
+	}
+	fmt.Printf("Disk: %s\n", path)
+	fmt.Printf(" Type: %s  Tracks: %d  Sides: %d\n",
+		map[diskType]string{dskStandard: "Standard", dskExtended: "Extended"}[d.kind], d.tracks, d.sides)
+	if d.creator != "" {
+		fmt.Printf(" Creator: %s\n", d.creator)
+	} else {
+		fmt.Printf(" Creator: (none)\n")
+	}
+	// Without sector data every track compares equal, so -info-only skips auto-detection.
+	if *flagDoubleStep || (!*flagInfoOnly && isDoubleStepped(d)) {
+		doubleStep(d)
+		fmt.Printf(" Double-stepped: reading every other track (%d logical tracks)\n", d.tracks)
+	}
+	if *flagTracks {
+		printTracks(d)
+		return
+	}
+	if *flagListTracks {
+		listTracks(d)
+		return
+	}
+	if *flagSectors {
+		printSectors(d)
+		return
+	}
+	if *flagGapData {
+		printGapData(d)
+		return
+	}
+	if del := deletedSectors(d); len(del) > 0 {
+		fmt.Printf(" Note: %d sector(s) carry a deleted-data address mark (%s); a protection signal, see -sectors\n",
+			len(del), strings.Join(del, ", "))
+	}
+
+	if mixed := mixedSizeTracks(d); len(mixed) > 0 {
+		fmt.Printf(" Warning: track(s) %v mix sector sizes; their sectors are read in ID order as one run of bytes, so check files there\n", mixed)
+	}
+
+	spec := specT0S1(d)
+	switch {
+	case looksPlus3Spec(spec):
+		printSpec(spec)
+	case !*flagAssume:
+		fmt.Println(" Not a +3 (PCW-180K) layout or missing +3 spec at T0,S1. Showing geometry only.")
+		return
+	default:
+		fmt.Printf(" Warning: T0,S1 holds no valid +3 spec (% X)\n", spec)
+		var replaced []string
+		spec, replaced = assumeSpec(d, spec)
+		d.assumed = spec
+		fmt.Printf(" Assuming the standard 180K +3 value of its %s (-assume-plus3)\n", strings.Join(replaced, ", "))
+		printSpec(spec)
+	}
+	printDiskKind(d, spec)
+	checkGeometry(d, spec)
+	if !standardLayout(spec) {
+		fmt.Println(" Directory listing is not supported for this layout.")
+		return
+	}
+	secs, err := dirSectors(d)
+	if err != nil {
+		fmt.Printf(" +3 spec found but directory not in +3 default layout: %v\n", err)
+		return
+	}
+	for _, r := range dirDuplicates(d) {
+		fmt.Printf(" Warning: directory track has several R=%d sectors; using the cleanest full-size copy\n", r)
+	}
+	if label, ok := dirLabel(secs); ok {
+		if label == "" {
+			label = "(blank)"
+		}
+		fmt.Printf(" Label: %s\n", label)
+	}
+	l := layoutOf(d)
+	entries := parseDir(secs, l.wide())
+	if len(entries) == 0 {
+		fmt.Println(" Directory: (empty)")
+		return
+	}
+
+	files := filesInUser(aggregate(entries, l.extentMask()), *flagUser)
+	if *flagMatch != "" {
+		var kept []fileAgg
+		for _, f := range files {
+			if wildMatch83(*flagMatch, f.Name, f.Ext) {
+				kept = append(kept, f)
+			}
+		}
+		fmt.Printf(" %d of %d file(s) match %s\n", len(kept), len(files), strings.ToUpper(*flagMatch))
+		files = kept
+	}
+	for _, f := range files {
+		for _, c := range f.Conflicts {
+			fmt.Printf(" Warning: %s.%s has duplicate extent %d (slots %d and %d); using slot %d (RC %d)\n",
+				f.Name, f.Ext, c.Extent, c.KeptSlot, c.DroppedSlot, c.KeptSlot, c.KeptRC)
+		}
+	}
+
+	if *flagListExtents {
+		listExtents(files)
+		return
+	}
+	if *flagChecksums {
+		if *flagInfoOnly {
+			fmt.Fprintf(os.Stderr, "-verify-checksums reads file data; it cannot be combined with -info-only\n")
+			os.Exit(2)
+		}
+		if verifyChecksums(d, files) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *flagTrace != "" {
+		if !traceFile(d, files, *flagTrace) {
+			fmt.Fprintf(os.Stderr, "%s: no such file on the disk\n", *flagTrace)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *flagFind != "" {
+		pat, err := parsePattern(*flagFind, *flagText)
+		if err != nil || len(pat) == 0 {
+			fmt.Fprintf(os.Stderr, "Bad -find pattern %q\n", *flagFind)
+			os.Exit(2)
+		}
+		fmt.Printf("\nSearching for %s (offsets include any +3DOS header):\n", hex.EncodeToString(pat))
+		hits := 0
+		for _, f := range files {
+			offs, err := findAll(newFileReader(d, f), pat)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, " %s.%s: read error: %v\n", f.Name, f.Ext, err)
+			}
+			for _, o := range offs {
+				fmt.Printf("  %3d  %s.%s  offset %d (0x%04X)\n", int(f.User), f.Name, f.Ext, o, o)
+			}
+			hits += len(offs)
+		}
+		fmt.Printf(" %d match(es)\n", hits)
+		return
+	}
+
+	previews := map[string]string{} // user:NAME.EXT -> hex, until its first entry is listed
+	if *flagPreview > 0 {
+		for _, f := range files {
+			p := fmt.Sprintf("% X", previewBytes(d, f, *flagPreview))
+			if p == "" {
+				p = "(no data)"
+			}
+			previews[fmt.Sprintf("%d:%s", f.User, fsName(f))] = p
+		}
+	}
+
+	capacity := l.dataBlocks()
+	fmt.Println("\nRaw directory entries:")
+	fmt.Println(" User  Name       Ext  Extent  RC   Blocks")
+	suspicious, corrupt := 0, 0
+	for _, e := range entries {
+		if *flagUser >= 0 && int(e.User) != *flagUser {
+			continue
+		}
+		if *flagMatch != "" && !wildMatch83(*flagMatch, e.Name, e.Ext) {
+			continue
+		}
+		if suspiciousUser(e.User) {
+			suspicious++
+			fmt.Printf("  ?%02X  %-8q %-5q (suspicious user byte, slot %d)\n", e.User, e.Name, e.Ext, e.Slot)
+			continue
+		}
+		extentNum := extentNumber(e)
+		var blkIdxs, outside []string
+		for _, b := range e.Blocks {
+			if b != 0 {
+				blkIdxs = append(blkIdxs, fmt.Sprintf("%d", int(b)))
+			}
+			if int(b) >= capacity {
+				outside = append(outside, fmt.Sprintf("%d", int(b)))
+			}
+		}
+		if len(blkIdxs) == 0 {
+			blkIdxs = []string{"-"} // zero-length file: a single RC 0 extent without blocks
+		}
+		preview := ""
+		key := fmt.Sprintf("%d:%s", e.User, fsName(fileAgg{Name: e.Name, Ext: e.Ext}))
+		if p, ok := previews[key]; ok {
+			preview = "  | " + p
+			delete(previews, key)
+		}
+		if a := attrNames(e.Attr); a != "" {
+			preview = "  [" + a + "]" + preview
+		}
+		if len(outside) > 0 {
+			corrupt++
+			preview = fmt.Sprintf("  CORRUPT: block(s) %s past the data area", strings.Join(outside, ",")) + preview
+		}
+		fmt.Printf("  %3d  %-8s   %-3s  %5d  %3d  %s%s\n", int(e.User), e.Name, e.Ext, extentNum, int(e.RC), strings.Join(blkIdxs, ","), preview)
+	}
+	dirN := len(alBlocks(d.dirAL))
+	inUse := map[int]bool{}
+	for _, e := range entries {
+		if e.User > 15 {
+			continue
+		}
+		for _, b := range e.Blocks {
+			if b != 0 && !isDirBlock(d.dirAL, int(b)) && int(b) < capacity {
+				inUse[int(b)] = true
+			}
+		}
+	}
+	fmt.Printf("\n Blocks: %d directory, %d in use, %d free (of %d)\n", dirN, len(inUse), capacity-dirN-len(inUse), capacity)
+	if corrupt > 0 {
+		fmt.Printf("\n Warning: %d entries list blocks past the %d-block data area; those entries are corrupt and the blocks cannot be read\n", corrupt, capacity)
+	}
+	if suspicious > 0 {
+		fmt.Printf("\n Warning: %d entries have user bytes outside 0..15; the directory may be misread (wrong geometry or offset?)\n", suspicious)
 	}
 }
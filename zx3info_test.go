@@ -0,0 +1,256 @@
+package main
+
+// Each tool is its own main package, so the tests are run one tool at a time:
+//
+//	go test zx3info.go zx3info_test.go wildmatch83_test.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildTool compiles another of the repo's tools, e.g. "zx3dsk", into a temporary
+// directory and returns the path of the binary.
+func buildTool(t *testing.T, name string) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), name)
+	if out, err := exec.Command("go", "build", "-o", bin, name+".go").CombinedOutput(); err != nil {
+		t.Fatalf("go build %s.go: %v\n%s", name, err, out)
+	}
+	return bin
+}
+
+// makeImage writes files to a folder and builds an image of it with zx3dsk, passing
+// args before the folder and image names.
+func makeImage(t *testing.T, files map[string][]byte, args ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(t.TempDir(), "test.dsk")
+	args = append(args, dir, image)
+	if out, err := exec.Command(buildTool(t, "zx3dsk"), args...).CombinedOutput(); err != nil {
+		t.Fatalf("zx3dsk %v: %v\n%s", args, err, out)
+	}
+	return image
+}
+
+func TestCatalog720K(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3000) // three 16KB extents
+	image := makeImage(t, map[string][]byte{"big.bin": big, "hi.txt": []byte("hello\n")}, "-format", "720k")
+	d, err := parseDSK(image, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := layoutOf(d); l.sides != 2 || l.blockSize != 2048 || !l.wide() {
+		t.Fatalf("layout %+v, want two sides of 2KB blocks with 16-bit numbers", l)
+	}
+	files, err := catalogFiles(image, d, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || fsName(files[0]) != "BIG.BIN" || fsName(files[1]) != "HI.TXT" {
+		t.Fatalf("catalog %+v, want BIG.BIN and HI.TXT", files)
+	}
+	got, err := io.ReadAll(newFileReader(d, files[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 128+len(big) || !bytes.Equal(got[128:128+len(big)], big) {
+		t.Errorf("BIG.BIN reads back as %d byte(s) that do not match what was written", len(got))
+	}
+}
+
+// writtenDirSectors finds the directory sectors of an image zx3dsk wrote with a full
+// directory of files F000.BIN, F001.BIN, ...: by the entries they hold, not by working
+// out the layout, in the order of the files they list.
+func writtenDirSectors(d *disk) []secLoc {
+	found := map[int]secLoc{}
+	for rec, trk := range d.Tracks {
+		for _, s := range trk.Sectors {
+			if len(s.Data) < 32 || !bytes.HasPrefix(s.Data, []byte{0, 'F'}) || string(s.Data[5:12]) != "    BIN" {
+				continue
+			}
+			if i, err := strconv.Atoi(string(s.Data[2:5])); err == nil {
+				found[i/(len(s.Data)/32)] = secLoc{rec, s.R}
+			}
+		}
+	}
+	var locs []secLoc
+	for k := 0; ; k++ {
+		loc, ok := found[k]
+		if !ok {
+			return locs
+		}
+		locs = append(locs, loc)
+	}
+}
+
+func TestDirectoryAgreesWithWriter(t *testing.T) {
+	for _, format := range []string{"180k", "720k"} {
+		// Fill every directory entry, so a reader that stops short loses files. The
+		// spec zx3dsk writes on a blank disk says how many there are.
+		blank, err := parseDSK(makeImage(t, nil, "-format", format), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec := specT0S1(blank)
+		n := int(spec[7]) * (128 << spec[6]) / 32
+		files := map[string][]byte{}
+		for i := 0; i < n; i++ {
+			files[fmt.Sprintf("f%03d.bin", i)] = []byte{byte(i)}
+		}
+		image := makeImage(t, files, "-format", format, "-noheader", "*")
+		d, err := parseDSK(image, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := layoutOf(d)
+		want := writtenDirSectors(d)
+		if len(want)*512 != n*32 {
+			t.Fatalf("%s: found %d directory sector(s) in the image for %d entries", format, len(want), n)
+		}
+		if got := dirLocations(l, dirAllocation(l.dirBlocks)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: directory sectors %v, want %v", format, got, want)
+		}
+		catalog, err := catalogFiles(image, d, false, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(catalog) != n {
+			t.Errorf("%s: catalog lists %d file(s), want %d", format, len(catalog), n)
+		}
+	}
+}
+
+func TestDiskFSModTimes(t *testing.T) {
+	when := time.Date(2001, 2, 3, 4, 5, 0, 0, time.UTC)
+	image := makeImage(t, map[string][]byte{"hi.txt": []byte("hello\n"), "b.bin": {1, 2, 3}},
+		"-timestamp", when.Format(time.RFC3339))
+	d, err := parseDSK(image, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := catalogFiles(image, d, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := newDiskFS(d, files)
+	var names []string
+	err = fs.WalkDir(fsys, ".", func(name string, de fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		names = append(names, name)
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Equal(when) {
+			t.Errorf("%s: mod time %v, want %v", name, info.ModTime(), when)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"B.BIN", "HI.TXT"}) {
+		t.Errorf("WalkDir found %v, want B.BIN and HI.TXT", names)
+	}
+	b, err := fs.ReadFile(fsys, "hi.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 134 || string(b[128:134]) != "hello\n" {
+		t.Errorf("hi.txt reads back as %q", b)
+	}
+}
+
+func TestUnreadableFileIsReported(t *testing.T) {
+	image := makeImage(t, map[string][]byte{"a.bin": []byte("contents")})
+	d, err := parseDSK(image, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ref bytes.Buffer
+	if err := streamCatalog(&ref, image, d, true, false, -1); err != nil {
+		t.Fatal(err)
+	}
+	refPath := filepath.Join(t.TempDir(), "ref.json")
+	if err := os.WriteFile(refPath, ref.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the data of the file's first block (block 2: T1 R5 and R6).
+	for i, s := range d.Tracks[1].Sectors {
+		if s.R == 5 {
+			d.Tracks[1].Sectors[i].Data = nil
+		}
+	}
+	var out bytes.Buffer
+	if err := streamCatalog(&out, image, d, true, false, -1); err != nil {
+		t.Fatal(err)
+	}
+	var rec fileJSON
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Unreadable == "" || rec.SHA256 != "" {
+		t.Errorf("record %+v, want the file reported unreadable without a sha256", rec)
+	}
+	problems, err := verifyCatalog(refPath, image, d, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "unreadable: 0:A.BIN") {
+		t.Errorf("verifyCatalog reported %q, want A.BIN unreadable", problems)
+	}
+}
+
+func TestAssumeKeepsPlausibleSpecFields(t *testing.T) {
+	image := makeImage(t, map[string][]byte{"hi.txt": []byte("hello\n")}, "-format", "720k")
+	b, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[512] = 0x55 // spec byte 0, the disk type, of T0 R1 after the Disk-Info and Track-Info blocks
+	if err := os.WriteFile(image, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseDSK(image, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := catalogFiles(image, d, false, -1); err == nil {
+		t.Fatal("catalogFiles read a disk with an invalid spec without -assume-plus3")
+	}
+	files, err := catalogFiles(image, d, true, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := layoutOf(d); l.sides != 2 || l.blockSize != 2048 || l.cyls != 80 {
+		t.Errorf("layout %+v, want the spec's 80 tracks on two sides of 2KB blocks", l)
+	}
+	if len(files) != 1 || fsName(files[0]) != "HI.TXT" {
+		t.Errorf("catalog %+v, want HI.TXT", files)
+	}
+
+	blank := bytes.Repeat([]byte{0xE5}, 16) // an unformatted spec sector
+	if spec, _ := assumeSpec(d, blank); !bytes.Equal(spec[:8], defaultSpec[:8]) {
+		t.Errorf("assumed spec % X for an unformatted sector, want the 180K default", spec)
+	}
+}